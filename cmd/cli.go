@@ -1,11 +1,17 @@
 package cmd
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	URL "net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/osm6495/cspscan/internal"
 	"github.com/spf13/cobra"
@@ -14,118 +20,498 @@ import (
 type Flags struct {
 	Url string
 	Threads int
+	PrimaryWorkers int
+	CheckWorkers int
+	HostRPS float64
+	HostConcurrency int
+	GlobalRPS float64
+	Jitter time.Duration
+	Retries int
+	RetryDelay time.Duration
+	ConnectTimeout time.Duration
+	ReadTimeout time.Duration
+	Timeout time.Duration
+	Proxy string
+	CACert string
+	Insecure bool
+	UserAgent string
+	MaxRedirects int
+	Headers []string
+	Cookies []string
+	CookieJar string
+	AuthAllHosts bool
+	Resolvers []string
+	Fingerprints string
+	CustomFingerprints []string
+	DisabledFingerprints []string
+	HTML bool
+	Method string
+	MinSeverity string
+	ShowErrors bool
+	Format string
+	Depth int
+	Output string
   verbose bool
 }
 
 var (
 	flags Flags
 	rootCmd = &cobra.Command{
-		Use:     "cspscan [options] <-u targetUrl | targetUrlList>",
+		Use:     "cspscan [options] <-u targetUrl | targetUrlList | ->",
 		Short:   `A CLI toolkit to find dangling cloud storage buckets in CSP directives.`,
 		Long: `A CLI toolkit to find dangling cloud storage buckets in Content Security Policy directives.`,
-		Run: func(cmd *cobra.Command, args []string) {
-			Scan(flags, args)
+		// Allow the target list as an argument, even though the command has subcommands
+		Args:    cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Flags were parsed fine, so don't print the usage for scan errors
+			cmd.SilenceUsage = true
+			return Scan(flags, args)
 		},
 	}
 )
 
 func init() {
 	rootCmd.Flags().StringVarP(&flags.Url, "url", "u", "", "specify a single URL, rather than a filepath to a list of URLs")
-	rootCmd.Flags().IntVarP(&flags.Threads, "threads", "t", 0, `limit the number of threads, which will 
-make one HEAD request to each input url, and one GET request to each url in the CSP for each input URL.
-A value of 0 will not limit the thread count.`)
+	rootCmd.Flags().IntVarP(&flags.Threads, "threads", "t", 0, `number of workers for both stages, unless --primary-workers or --check-workers is set. 
+A value of 0 uses the default for each stage.`)
+	rootCmd.Flags().IntVar(&flags.PrimaryWorkers, "primary-workers", 0, fmt.Sprintf(`number of workers fetching the CSPs of input urls 
+(default %d)`, internal.DefaultPrimaryWorkers))
+	rootCmd.Flags().IntVar(&flags.CheckWorkers, "check-workers", 0, fmt.Sprintf(`number of workers checking the urls found in CSPs 
+(default %d)`, internal.DefaultCheckWorkers))
   rootCmd.Flags().BoolVarP(&flags.verbose, "verbose", "v", false, "output all scanned URLs, even if not vulnerable")
+	rootCmd.Flags().StringSliceVar(&flags.Resolvers, "resolver", nil, `comma separated list of nameservers to use for DNS lookups, 
+like 1.1.1.1,8.8.8.8. Defaults to the system resolver.`)
+	rootCmd.Flags().StringVar(&flags.Fingerprints, "fingerprints", "", `load subdomain takeover fingerprints from a file, rather than 
+the cache (updated with "cspscan fingerprints update") or the built-in fingerprints`)
+	rootCmd.Flags().StringArrayVar(&flags.CustomFingerprints, "custom-fingerprints", nil, `JSON or YAML file of fingerprints to merge with the upstream fingerprints. 
+Fingerprints replace upstream ones with the same service name, or disable them with "vulnerable: false". Can be repeated.`)
+	rootCmd.Flags().BoolVar(&flags.HTML, "html", false, `send a GET request to each input url instead of HEAD, and also parse 
+CSPs delivered in <meta http-equiv="Content-Security-Policy"> tags`)
+	rootCmd.Flags().StringVar(&flags.Method, "method", internal.MethodAuto, `request method for input urls: "head", "get", or "auto" to send 
+a HEAD request and fall back to GET if it fails, is rejected, or has no CSP`)
+	rootCmd.Flags().StringVar(&flags.MinSeverity, "min-severity", "info", `only output findings with at least this severity (info, low, medium or high). 
+Severity is based on the CSP directive, lowered for report-only policies and edge case fingerprints.`)
+	rootCmd.Flags().BoolVar(&flags.ShowErrors, "show-errors", false, "print URLs that couldn't be scanned and why. Errors are always counted in the summary.")
+	rootCmd.Flags().StringVar(&flags.Format, "format", internal.FormatConsole, `output format: "console", "json" for a single array of every result, 
+"jsonl" for one result per line, "csv" for one row per primary and secondary URL pair, 
+"sarif" for a SARIF 2.1.0 log of the findings, or "html" for a static report`)
+	rootCmd.Flags().IntVar(&flags.Depth, "depth", 0, `also fetch the CSPs of URLs found in CSPs, up to this many levels deep, 
+and check their sources too. Each host is only followed once.`)
+	rootCmd.Flags().StringVarP(&flags.Output, "output", "o", "", "write results to a file instead of stdout")
+	rootCmd.Flags().Float64Var(&flags.HostRPS, "host-rps", 0, "maximum requests per second to a single host. A value of 0 will not limit the rate.")
+	rootCmd.Flags().IntVar(&flags.HostConcurrency, "host-concurrency", 0, "maximum requests in flight to a single host at once. A value of 0 will not limit it.")
+	rootCmd.Flags().Float64Var(&flags.GlobalRPS, "global-rps", 0, "maximum requests per second across every host. A value of 0 will not limit the rate.")
+	rootCmd.Flags().DurationVar(&flags.Jitter, "jitter", 0, "add a random delay of up to this long before each request, like 250ms")
+	rootCmd.PersistentFlags().IntVar(&flags.Retries, "retries", 2, `times to retry a request after a connection reset, timeout, 429 or 5xx response. 
+A value of 0 will not retry.`)
+	rootCmd.PersistentFlags().DurationVar(&flags.RetryDelay, "retry-delay", 500*time.Millisecond, `delay before the first retry, doubled for each retry after it. 
+Retry-After headers are respected, up to 30s.`)
+	rootCmd.PersistentFlags().DurationVar(&flags.ConnectTimeout, "connect-timeout", 10*time.Second, "time to open a connection, including the TLS handshake. A value of 0 will not time out.")
+	rootCmd.PersistentFlags().DurationVar(&flags.ReadTimeout, "read-timeout", 10*time.Second, "time to wait for the response headers once a request is sent. A value of 0 will not time out.")
+	rootCmd.PersistentFlags().DurationVar(&flags.Timeout, "timeout", 30*time.Second, `time for each request sent, including reading the response. Retries and redirects 
+get their own, and waiting for rate limits doesn't count. A value of 0 will not time out.`)
+	rootCmd.PersistentFlags().StringVar(&flags.Proxy, "proxy", "", `send requests through an HTTP or SOCKS5 proxy, like http://127.0.0.1:8080 
+or socks5://127.0.0.1:1080. Defaults to the HTTP_PROXY and HTTPS_PROXY environment variables.`)
+	rootCmd.PersistentFlags().StringVar(&flags.CACert, "ca-cert", "", "PEM file of CA certificates to trust on top of the system ones, like a proxy's CA")
+	rootCmd.PersistentFlags().BoolVarP(&flags.Insecure, "insecure", "k", false, "don't verify TLS certificates")
+	rootCmd.PersistentFlags().StringVar(&flags.UserAgent, "user-agent", internal.DefaultUserAgent, "User-Agent header sent with every request")
+	rootCmd.PersistentFlags().IntVar(&flags.MaxRedirects, "max-redirects", internal.DefaultMaxRedirects, "redirects to follow before using the last response. A value of 0 will not follow redirects.")
+	rootCmd.Flags().StringArrayVarP(&flags.Headers, "header", "H", nil, `header to send with requests for input urls, like "Authorization: Bearer token". 
+Can be repeated.`)
+	rootCmd.Flags().StringArrayVar(&flags.Cookies, "cookie", nil, `cookies to send with requests for input urls, like "session=abc; theme=dark". 
+Can be repeated.`)
+	rootCmd.Flags().StringVar(&flags.CookieJar, "cookie-jar", "", `Netscape format cookie file, like one written by curl -c. 
+Each cookie is only sent to the domain it was set for.`)
+	rootCmd.Flags().BoolVar(&flags.AuthAllHosts, "auth-all-hosts", false, `also send --header and --cookie to pages on other hosts, 
+like followed pages with --depth and cross-host redirects`)
+	rootCmd.Flags().StringArrayVar(&flags.DisabledFingerprints, "disable-fingerprint", nil, "service name of a fingerprint to skip, like \"Github\". Can be repeated.")
 }
 
-func parseInputFile(filepath string) ([]string, error) {
-	data, err := os.ReadFile(filepath)
-	if err != nil {
-		return nil, err
+// Clean up a target URL from the input. Returns false if the line isn't a usable URL.
+func normalizeTarget(url string) (string, bool) {
+	url = strings.TrimSpace(url)
+	if url == "" {
+		return "", false
 	}
 
 	// Probably not necessary, but prevents command injection/privilege escalation in the 
 	// oddly specific scenario where this program is somwhow running with more permissions
 	// than the user and the user has access to modify the url input file. 
 	// Still need to avoid exposing contents of the file, to avoid unprivileged reads.
-	for _, char := range string(data) {
-		if char == '&' || char == ';' || char == '\''{
-			return nil, fmt.Errorf("invalid character (& or ; or ') found in url file")
-		}
+	if strings.ContainsAny(url, "&;'") {
+		return "", false
 	}
 
-	contents := strings.Split(string(data), "\n")
-	if len(contents) == 0 {
-		return nil, fmt.Errorf("failed to read file: No contents found")
+	// Remove wildcard port (":*") if present
+	url = strings.Replace(url, ":*", "", 1)
+
+	// Add "https://" if no protocol to make it a valid URL
+	if !strings.Contains(url, "://") {
+		url = "https://" + url
 	}
 
-  for i, url := range contents {
-    // Remove wildcard port (":*") if present
-    url = strings.Replace(url, ":*", "", 1)
+	parsedURL, err := URL.Parse(url)
+	if err != nil || parsedURL.Host == "" {
+		return "", false
+	}
 
-    // Add "http://" if no protocol to make it a valid URL
-    if !strings.Contains(url, "://") {
-      url = "https://" + url
-    }
+	if !strings.Contains(parsedURL.Host, ".") {
+		return "", false // Skip if no TLD
+	}
 
-    // Parse the URL and clean up any wildcard ports (like ":*")
-    parsedURL, err := URL.Parse(url)
-    if err != nil || parsedURL.Host == "" {
-      continue
-    }
+	// Ignore wildcard subdomains
+	parsedURL.Host = strings.Replace(parsedURL.Host, "*.", "", 1)
 
-    if !strings.Contains(parsedURL.Host, ".") {
-      continue // Skip if no TLD
-    }
-    
-    // Ignore wildcard subdomains
-    parsedURL.Host = strings.Replace(parsedURL.Host, "*.", "", 1)
+	return parsedURL.String(), true
+}
 
-    contents[i] = parsedURL.String()
-  }
+// Read target URLs from r line by line, sending each usable one to targets as soon as it is read,
+// so large lists and piped input are scanned without reading them in full first. Reading stops early
+// once stop is closed.
+func readTargets(r io.Reader, targets chan<- string, stop <-chan struct{}) error {
+	scanner := bufio.NewScanner(r)
+	skipped := 0
+	for scanner.Scan() {
+		target, ok := normalizeTarget(scanner.Text())
+		if !ok {
+			if strings.TrimSpace(scanner.Text()) != "" {
+				skipped++
+			}
+			continue
+		}
+
+		select {
+		case targets <- target:
+		case <-stop:
+			return nil
+		}
+	}
 
-	return contents, nil
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "Skipped %d invalid input lines\n", skipped)
+	}
+
+	return scanner.Err()
 }
 
-func Scan(flags Flags, args []string) {
-	var input []string
-	if flags.Url != "" {
-		input = append(input, flags.Url)
-	} else {
-		if len(args) > 0 {
-			filepath := args[0]
+// Open the input targets are read from: stdin when the argument is "-" or input is piped in,
+// otherwise the file in the first argument.
+func openInput(args []string) (io.ReadCloser, error) {
+	if len(args) > 0 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to open input file: %v", err)
+		}
+		return file, nil
+	}
 
-			var err error
-			input, err = parseInputFile(filepath)
+	if len(args) == 0 {
+		stat, err := os.Stdin.Stat()
+		if err != nil || stat.Mode()&os.ModeCharDevice != 0 {
+			return nil, fmt.Errorf("missing URL or filepath")
+		}
+	}
 
-			if err != nil {
-				panic(fmt.Errorf("failed to parse input file: %v", err))
-			}
-		} else {
-			panic(fmt.Errorf("missing URL or filepath"))
+	return io.NopCloser(os.Stdin), nil
+}
+
+// Longest delay between retries, including delays asked for with Retry-After
+const maxRetryDelay = 30 * time.Second
+
+// Longest connect and read timeouts when revalidating the fingerprint cache at the start of a scan
+const fingerprintRevalidateTimeout = 5 * time.Second
+
+// How long in-flight requests get to finish after an interrupt before they are aborted
+const interruptGracePeriod = 10 * time.Second
+
+// Stop the scan gracefully on SIGINT or SIGTERM. The returned channel is closed on the first signal,
+// which stops reading new targets, and cancel is called after interruptGracePeriod or on a second
+// signal, which aborts the requests still in flight.
+func handleInterrupts(ctx context.Context, cancel context.CancelFunc) <-chan struct{} {
+	interrupted := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case <-signals:
+		case <-ctx.Done():
+			return
+		}
+
+		close(interrupted)
+		fmt.Fprintf(os.Stderr, "Interrupted, waiting up to %s for in-flight requests. Press Ctrl+C again to stop now.\n", interruptGracePeriod)
+
+		select {
+		case <-signals:
+		case <-time.After(interruptGracePeriod):
+		case <-ctx.Done():
 		}
+		cancel()
+	}()
+
+	return interrupted
+}
+
+func Scan(flags Flags, args []string) error {
+	var input io.ReadCloser
+	if flags.Url == "" {
+		var err error
+		input, err = openInput(args)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
 	}
 
-	maxThreads := len(input)
-	if (flags.Threads == 0) {
-		maxThreads = flags.Threads
+	minSeverity, err := internal.ParseSeverity(flags.MinSeverity)
+	if err != nil {
+		return err
 	}
 
-	client := http.DefaultClient
+	if flags.Threads < 0 || flags.PrimaryWorkers < 0 || flags.CheckWorkers < 0 {
+		return fmt.Errorf("number of workers must be 0 or more")
+	}
 
-	fingerprints, err := internal.GetFingerprints("", client)
+	// --threads sets both stages, and 0 leaves a stage on its default
+	primaryWorkers := flags.Threads
+	if flags.PrimaryWorkers != 0 {
+		primaryWorkers = flags.PrimaryWorkers
+	}
+	checkWorkers := flags.Threads
+	if flags.CheckWorkers != 0 {
+		checkWorkers = flags.CheckWorkers
+	}
+
+	if flags.HostRPS < 0 || flags.HostConcurrency < 0 || flags.GlobalRPS < 0 || flags.Jitter < 0 {
+		return fmt.Errorf("rate limits must be 0 or more")
+	}
+
+	limiter := internal.NewRateLimiter(internal.RateLimitOptions{
+		HostRPS:         flags.HostRPS,
+		HostConcurrency: flags.HostConcurrency,
+		GlobalRPS:       flags.GlobalRPS,
+		Jitter:          flags.Jitter,
+	})
+
+	client, err := newClient(flags, limiter)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	resolver := internal.NewSystemResolver()
+	if len(flags.Resolvers) > 0 {
+		resolver = internal.NewNameserverResolver(flags.Resolvers)
+	}
+
+	// Revalidating the fingerprint cache gets a single quick attempt, so networks that drop
+	// packets to GitHub don't stall every scan before it falls back to the cache
+	revalidateFlags := flags
+	revalidateFlags.Retries = 0
+	revalidateFlags.ConnectTimeout = shorterTimeout(flags.ConnectTimeout, fingerprintRevalidateTimeout)
+	revalidateFlags.ReadTimeout = shorterTimeout(flags.ReadTimeout, fingerprintRevalidateTimeout)
+	revalidateClient, err := newClient(revalidateFlags, limiter)
+	if err != nil {
+		return err
+	}
+
+	fingerprints, err := loadFingerprints(flags, revalidateClient)
+	if err != nil {
+		return err
 	}
 
 	urlsChannel := make(chan internal.Result)
 	resultChannel := make(chan internal.Result)
 
-	go internal.ProcessPrimaryURLs(input, urlsChannel, maxThreads, client)
-	go internal.ProcessSecondaryURLs(urlsChannel, resultChannel, maxThreads, client, fingerprints)
+	if flags.Depth < 0 {
+		return fmt.Errorf("depth must be 0 or more")
+	}
+
+	options := internal.CSPOptions{HTML: flags.HTML, Method: flags.Method, AuthAllHosts: flags.AuthAllHosts}
+	err = options.Validate()
+	if err != nil {
+		return err
+	}
+
+	options.Headers, err = internal.ParseHeaders(flags.Headers)
+	if err != nil {
+		return err
+	}
+	for _, line := range flags.Cookies {
+		cookies, err := internal.ParseCookies(line)
+		if err != nil {
+			return err
+		}
+		options.Cookies = append(options.Cookies, cookies...)
+	}
+	if flags.CookieJar != "" {
+		options.CookieJar, err = internal.LoadCookieFile(flags.CookieJar)
+		if err != nil {
+			return err
+		}
+	}
+
+	out := os.Stdout
+	if flags.Output != "" {
+		out, err = os.Create(flags.Output)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %v", err)
+		}
+		defer out.Close()
+	}
+
+	writer, err := internal.NewWriter(flags.Format, out, internal.WriterOptions{
+		Verbose:    flags.verbose,
+		ShowErrors: flags.ShowErrors,
+		Services:   internal.ScanServices(fingerprints),
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupted := handleInterrupts(ctx, cancel)
+
+	targets := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		// A single URL is used as is, without the clean up the input lists get
+		if input == nil {
+			targets <- flags.Url
+			readErr <- nil
+		} else {
+			readErr <- readTargets(input, targets, interrupted)
+		}
+		close(targets)
+	}()
+
+	go internal.ProcessPrimaryURLs(ctx, targets, urlsChannel, primaryWorkers, client, options, flags.Depth)
+	go internal.ProcessSecondaryURLs(ctx, urlsChannel, resultChannel, checkWorkers, client, resolver, fingerprints)
   
+	var summary internal.Summary
 	for result := range resultChannel {
-		internal.ToConsole(result, flags.verbose)
+		summary.Add(result)
+		if result.Vulnerable && result.Severity < minSeverity {
+			continue
+		}
+
+		err = writer.Write(result)
+		if err != nil {
+			return fmt.Errorf("failed to write result: %v", err)
+		}
+	}
+
+	select {
+	case <-interrupted:
+		fmt.Fprintln(os.Stderr, "Scan interrupted, results are partial")
+	default:
+	}
+
+	summary.ToConsole()
+	err = writer.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write results: %v", err)
+	}
+
+	select {
+	case <-interrupted:
+		return fmt.Errorf("scan interrupted")
+	default:
+	}
+
+	// Without an interrupt, the targets channel was closed after the read error was sent,
+	// so it's already waiting here
+	err = <-readErr
+	if err != nil {
+		return fmt.Errorf("failed to read input: %v", err)
+	}
+
+	return nil
+}
+
+// Build the HTTP client for the request flags, with every request waiting for limiter.
+// Retries happen outside the rate limiter, so every attempt waits for its own slot.
+func newClient(flags Flags, limiter *internal.RateLimiter) (*http.Client, error) {
+	if flags.Retries < 0 || flags.RetryDelay < 0 {
+		return nil, fmt.Errorf("--retries and --retry-delay must be 0 or more")
+	}
+
+	if flags.ConnectTimeout < 0 || flags.ReadTimeout < 0 || flags.Timeout < 0 {
+		return nil, fmt.Errorf("timeouts must be 0 or more")
+	}
+	if flags.MaxRedirects < 0 {
+		return nil, fmt.Errorf("--max-redirects must be 0 or more")
 	}
+
+	clientOptions := internal.ClientOptions{
+		ConnectTimeout: flags.ConnectTimeout,
+		ReadTimeout:    flags.ReadTimeout,
+		Timeout:        flags.Timeout,
+		Proxy:          flags.Proxy,
+		CACert:         flags.CACert,
+		Insecure:       flags.Insecure,
+		UserAgent:      flags.UserAgent,
+		MaxRedirects:   flags.MaxRedirects,
+	}
+	transport, err := internal.NewTransport(clientOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return internal.NewClient(internal.NewRetryTransport(limiter.Transport(transport), internal.RetryOptions{
+		MaxRetries: flags.Retries,
+		BaseDelay:  flags.RetryDelay,
+		MaxDelay:   maxRetryDelay,
+	}), clientOptions), nil
+}
+
+// Get the shorter of two timeouts, where 0 means no timeout.
+func shorterTimeout(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Load the upstream fingerprints and merge the custom fingerprint files into them.
+func loadFingerprints(flags Flags, client *http.Client) ([]internal.Fingerprint, error) {
+	fingerprints, err := loadUpstreamFingerprints(flags, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var custom []internal.Fingerprint
+	for _, path := range flags.CustomFingerprints {
+		fingerprints, err := internal.LoadCustomFingerprints(path)
+		if err != nil {
+			return nil, err
+		}
+		custom = append(custom, fingerprints...)
+	}
+
+	return internal.MergeFingerprints(fingerprints, custom, flags.DisabledFingerprints), nil
+}
+
+// Load fingerprints from the --fingerprints file if provided, otherwise from the cache, revalidating
+// it against upstream once it is a day old. If there is no usable cache, the fingerprints built into the binary are used.
+func loadUpstreamFingerprints(flags Flags, client *http.Client) ([]internal.Fingerprint, error) {
+	if flags.Fingerprints != "" {
+		return internal.LoadFingerprints(flags.Fingerprints)
+	}
+
+	cacheDir, err := internal.FingerprintCacheDir()
+	if err == nil {
+		var fingerprints []internal.Fingerprint
+		fingerprints, err = internal.GetCachedFingerprints(cacheDir, "", client)
+		if err == nil {
+			return fingerprints, nil
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Using built-in fingerprints from %s, %v\n", internal.EmbeddedFingerprintsSource(), err)
+	return internal.EmbeddedFingerprints()
 }
 
 func Execute() error {
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/osm6495/cspscan/internal"
+	"github.com/spf13/cobra"
+)
+
+var (
+	fingerprintsCmd = &cobra.Command{
+		Use:   "fingerprints",
+		Short: "Manage the subdomain takeover fingerprints used by scans",
+	}
+
+	updateFingerprintsCmd = &cobra.Command{
+		Use:   "update",
+		Short: "Download the latest fingerprints from can-i-take-over-xyz into the local cache",
+		Args:  cobra.NoArgs,
+		// Network failures aren't usage errors
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return UpdateFingerprints(flags)
+		},
+	}
+)
+
+func init() {
+	fingerprintsCmd.AddCommand(updateFingerprintsCmd)
+	rootCmd.AddCommand(fingerprintsCmd)
+}
+
+// Download the latest fingerprints into the cache, through the same proxy, CA certificates and
+// timeouts as a scan with the same flags.
+func UpdateFingerprints(flags Flags) error {
+	cacheDir, err := internal.FingerprintCacheDir()
+	if err != nil {
+		return err
+	}
+
+	client, err := newClient(flags, internal.NewRateLimiter(internal.RateLimitOptions{}))
+	if err != nil {
+		return err
+	}
+
+	updated, err := internal.UpdateFingerprintCache(cacheDir, "", client)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(cacheDir, "fingerprints.json")
+	if !updated {
+		fmt.Printf("Fingerprints are already up to date: %s\n", path)
+		return nil
+	}
+
+	fingerprints, err := internal.LoadFingerprints(path)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Updated %d fingerprints: %s\n", len(fingerprints), path)
+	return nil
+}
@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	URL "net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parse headers in the "Name: value" form, like curl's -H. Repeated names are all sent.
+func ParseHeaders(lines []string) (http.Header, error) {
+	headers := http.Header{}
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("invalid header %q, expected \"Name: value\"", line)
+		}
+		headers.Add(name, strings.TrimSpace(value))
+	}
+	return headers, nil
+}
+
+// Parse cookies in the "name=value; name2=value2" form of a Cookie header.
+func ParseCookies(line string) ([]*http.Cookie, error) {
+	cookies, err := http.ParseCookie(line)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cookies %q: %w", line, err)
+	}
+	return cookies, nil
+}
+
+// Load a Netscape format cookie file, like one written by curl -c or exported from a browser.
+// Each cookie is only sent to the domain and path it was set for, and expired cookies are skipped.
+func LoadCookieFile(path string) (http.CookieJar, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cookie file: %w", err)
+	}
+	defer file.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		httpOnly := false
+		if rest, ok := strings.CutPrefix(text, "#HttpOnly_"); ok {
+			text, httpOnly = rest, true
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		// domain, include subdomains, path, secure, expires, name, value
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("invalid cookie on line %d of %s: expected 7 tab separated fields", line, path)
+		}
+
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cookie expiry on line %d of %s: %w", line, path, err)
+		}
+
+		host := strings.TrimPrefix(fields[0], ".")
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		// Cookies without a domain are only sent to the exact host that set them
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = host
+		}
+		// An expiry of 0 is a session cookie, which never expires within a scan
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		jar.SetCookies(&URL.URL{Scheme: scheme, Host: host, Path: cookie.Path}, []*http.Cookie{cookie})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read cookie file: %w", err)
+	}
+
+	return jar, nil
+}
+
+// Add the headers and cookies in the options to a request for a page.
+func (o CSPOptions) authorize(req *http.Request) {
+	for name, values := range o.Headers {
+		if strings.EqualFold(name, "Host") {
+			req.Host = values[len(values)-1]
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	for _, cookie := range o.Cookies {
+		req.AddCookie(cookie)
+	}
+	if o.CookieJar != nil {
+		for _, cookie := range o.CookieJar.Cookies(req.URL) {
+			req.AddCookie(cookie)
+		}
+	}
+}
+
+// Get the options without Headers and Cookies, for pages on hosts the scan wasn't pointed at.
+// Cookies from CookieJar are kept, since they are only sent to the hosts they were set for.
+func (o CSPOptions) withoutAuth() CSPOptions {
+	o.Headers = nil
+	o.Cookies = nil
+	return o
+}
+
+// Get a copy of client that strips Headers and Cookies from redirects to other hosts, unless
+// AuthAllHosts is set. Cookies from CookieJar are sent to the hosts they match after each redirect.
+func (o CSPOptions) redirectClient(client *http.Client) *http.Client {
+	if len(o.Headers) == 0 && len(o.Cookies) == 0 && o.CookieJar == nil {
+		return client
+	}
+
+	redirectClient := *client
+	checkRedirect := client.CheckRedirect
+	redirectClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		// The previous request's headers have already been copied onto req, apart from the ones
+		// net/http drops for other domains, so reset them for the new host
+		if !strings.EqualFold(req.URL.Hostname(), via[0].URL.Hostname()) {
+			for name := range o.Headers {
+				req.Header.Del(name)
+			}
+			req.Header.Del("Cookie")
+			req.Host = ""
+
+			if o.AuthAllHosts {
+				o.authorize(req)
+			} else {
+				o.withoutAuth().authorize(req)
+			}
+		}
+
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return &redirectClient
+}
@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	URL "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseHeaders(t *testing.T) {
+	headers, err := ParseHeaders([]string{"Authorization: Bearer abc", "x-api-key:key", "X-Api-Key: other", "X-Empty:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := headers.Get("Authorization"); got != "Bearer abc" {
+		t.Errorf("expected the Authorization header, got %q", got)
+	}
+	if got := headers.Values("X-Api-Key"); len(got) != 2 || got[0] != "key" || got[1] != "other" {
+		t.Errorf("expected both X-Api-Key values, got %v", got)
+	}
+	if _, ok := headers["X-Empty"]; !ok {
+		t.Error("expected a header with an empty value")
+	}
+
+	for _, line := range []string{"no colon", ": value", "Bad Name: value"} {
+		if _, err := ParseHeaders([]string{line}); err == nil {
+			t.Errorf("expected an error for %q", line)
+		}
+	}
+}
+
+func TestParseCookies(t *testing.T) {
+	cookies, err := ParseCookies("session=abc; theme=dark")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cookies) != 2 || cookies[0].Name != "session" || cookies[1].Value != "dark" {
+		t.Errorf("expected 2 cookies, got %v", cookies)
+	}
+
+	if _, err := ParseCookies("not a cookie"); err == nil {
+		t.Error("expected an error for an invalid cookie")
+	}
+}
+
+func TestLoadCookieFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	expires := time.Now().Add(time.Hour).Unix()
+	lines := []string{
+		"# Netscape HTTP Cookie File",
+		fmt.Sprintf(".example.com\tTRUE\t/\tFALSE\t%d\tshared\t1", expires),
+		fmt.Sprintf("#HttpOnly_app.example.com\tFALSE\t/\tTRUE\t%d\tsession\t2", expires),
+		"app.example.com\tFALSE\t/admin\tFALSE\t0\tadmin\t3",
+		"app.example.com\tFALSE\t/\tFALSE\t1\texpired\t4",
+		"",
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	jar, err := LoadCookieFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := func(rawURL string) string {
+		url, _ := URL.Parse(rawURL)
+		var out []string
+		for _, cookie := range jar.Cookies(url) {
+			out = append(out, cookie.Name)
+		}
+		sort.Strings(out)
+		return strings.Join(out, ",")
+	}
+
+	tests := map[string]string{
+		"https://app.example.com/":      "session,shared",
+		"http://app.example.com/":       "shared",
+		"https://app.example.com/admin": "admin,session,shared",
+		"https://www.example.com/":      "shared",
+		"https://example.net/":          "",
+	}
+	for url, expected := range tests {
+		if got := names(url); got != expected {
+			t.Errorf("%s: expected cookies %q, got %q", url, expected, got)
+		}
+	}
+
+	if err := os.WriteFile(path, []byte("example.com\tTRUE\t/\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadCookieFile(path); err == nil {
+		t.Error("expected an error for a line without 7 fields")
+	}
+}
+
+// A server that records the Authorization and Cookie headers of each request.
+type authRecorder struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (r *authRecorder) record(req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req.Header.Get("Authorization")+"|"+req.Header.Get("Cookie"))
+}
+
+func (r *authRecorder) last() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.requests) == 0 {
+		return ""
+	}
+	return r.requests[len(r.requests)-1]
+}
+
+func TestGetCSPAuth(t *testing.T) {
+	var target authRecorder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target.record(r)
+		w.Header().Set("Content-Security-Policy", "script-src https://example.com")
+	}))
+	defer server.Close()
+
+	options := CSPOptions{
+		Method:  MethodGet,
+		Headers: http.Header{"Authorization": {"Bearer abc"}},
+		Cookies: []*http.Cookie{{Name: "session", Value: "1"}},
+	}
+	if _, err := GetCSP(context.Background(), server.URL, http.DefaultClient, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := target.last(); got != "Bearer abc|session=1" {
+		t.Errorf("expected the headers and cookies to be sent, got %q", got)
+	}
+}
+
+func TestGetCSPAuthRedirects(t *testing.T) {
+	var other authRecorder
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		other.record(r)
+	}))
+	defer otherServer.Close()
+	// A different host name for the same server, so the redirect is to another host
+	otherURL := strings.Replace(otherServer.URL, "127.0.0.1", "localhost", 1)
+
+	var target authRecorder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target.record(r)
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/done", http.StatusFound)
+		case "/other":
+			http.Redirect(w, r, otherURL, http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	options := CSPOptions{
+		Method:  MethodGet,
+		Headers: http.Header{"Authorization": {"Bearer abc"}},
+		Cookies: []*http.Cookie{{Name: "session", Value: "1"}},
+	}
+
+	if _, err := GetCSP(context.Background(), server.URL+"/same", http.DefaultClient, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := target.last(); got != "Bearer abc|session=1" {
+		t.Errorf("expected a redirect on the same host to keep the headers and cookies, got %q", got)
+	}
+
+	if _, err := GetCSP(context.Background(), server.URL+"/other", http.DefaultClient, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := other.last(); got != "|" {
+		t.Errorf("expected a redirect to another host to drop the headers and cookies, got %q", got)
+	}
+
+	options.AuthAllHosts = true
+	if _, err := GetCSP(context.Background(), server.URL+"/other", http.DefaultClient, options); err != nil {
+		t.Fatal(err)
+	}
+	if got := other.last(); got != "Bearer abc|session=1" {
+		t.Errorf("expected --auth-all-hosts to send the headers and cookies after a redirect, got %q", got)
+	}
+}
+
+func TestProcessPrimaryURLsAuthDepth(t *testing.T) {
+	var followed authRecorder
+	followedServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		followed.record(r)
+	}))
+	defer followedServer.Close()
+
+	var target authRecorder
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target.record(r)
+		w.Header().Set("Content-Security-Policy", "script-src "+followedServer.URL)
+	}))
+	defer server.Close()
+
+	scan := func(options CSPOptions) {
+		urlsChannel := make(chan Result)
+		go ProcessPrimaryURLs(context.Background(), targets([]string{server.URL}), urlsChannel, 0, http.DefaultClient, options, 1)
+		for result := range urlsChannel {
+			if result.Error != nil {
+				t.Error(result.Error)
+			}
+		}
+	}
+
+	options := CSPOptions{Method: MethodGet, Headers: http.Header{"Authorization": {"Bearer abc"}}}
+	scan(options)
+	if got := target.last(); got != "Bearer abc|" {
+		t.Errorf("expected the input URL to get the headers, got %q", got)
+	}
+	if got := followed.last(); got != "|" {
+		t.Errorf("expected the followed page to not get the headers, got %q", got)
+	}
+
+	options.AuthAllHosts = true
+	scan(options)
+	if got := followed.last(); got != "Bearer abc|" {
+		t.Errorf("expected --auth-all-hosts to send the headers to the followed page, got %q", got)
+	}
+}
@@ -0,0 +1,341 @@
+package internal
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	URL "net/url"
+	"regexp"
+	"strings"
+)
+
+// Cloud storage providers with dedicated bucket checks
+const (
+	ProviderS3           = "AWS/S3"
+	ProviderGCS          = "Google Cloud Storage"
+	ProviderAzureBlob    = "Microsoft Azure Blob Storage"
+	ProviderSpaces       = "DigitalOcean Spaces"
+	ProviderCloudflareR2 = "Cloudflare R2"
+)
+
+type BucketState string
+
+const (
+	// The bucket doesn't exist. See Bucket.Claimable for whether anyone can create it.
+	BucketNonexistent BucketState = "nonexistent"
+	// The bucket exists, but its contents can't be listed anonymously
+	BucketPrivate BucketState = "private"
+	// The bucket exists and anyone can list its contents
+	BucketPublicListable BucketState = "public-listable"
+)
+
+// Maximum size of a bucket listing response that is read, since only the start is needed to classify it
+const maxBucketResponseSize = 1 << 20
+
+// Cloud storage bucket referenced by a URL, either directly or through a CNAME.
+type Bucket struct {
+	Provider string `json:"provider"`
+	// Bucket name, or storage account name for Azure
+	Name string `json:"name,omitempty"`
+	// Container in the Azure storage account, if the URL had one
+	Container string `json:"container,omitempty"`
+	// Base URL of the storage API the bucket is checked through, like "https://s3.us-west-2.amazonaws.com"
+	Endpoint string      `json:"endpoint"`
+	State    BucketState `json:"state"`
+	// Anyone could create the bucket, so a CSP source pointing at it can be taken over
+	Claimable bool `json:"claimable"`
+	// HTTP status of the listing request, or 0 if the endpoint didn't resolve
+	Status int `json:"status,omitempty"`
+}
+
+// Get the URL that lists the bucket's contents anonymously.
+func (b Bucket) listURL() string {
+	switch b.Provider {
+	case ProviderAzureBlob:
+		if b.Container == "" {
+			return b.Endpoint + "/?comp=list"
+		}
+		return b.Endpoint + "/" + URL.PathEscape(b.Container) + "?restype=container&comp=list"
+	case ProviderCloudflareR2:
+		if b.Name == "" {
+			// Public r2.dev URLs only identify the bucket through the host
+			return b.Endpoint + "/"
+		}
+	}
+
+	return b.Endpoint + "/" + URL.PathEscape(b.Name) + "/"
+}
+
+// Describe the bucket's state, like "AWS/S3 bucket assets is nonexistent".
+func (b Bucket) evidence() string {
+	name := b.Name
+	if b.Container != "" {
+		name += "/" + b.Container
+	}
+	if name == "" {
+		name = b.Endpoint
+	}
+
+	evidence := fmt.Sprintf("%s bucket %s is %s", b.Provider, name, b.State)
+	if b.Claimable {
+		evidence += " and can be claimed"
+	}
+	return evidence
+}
+
+// Check if the bucket is a GCS bucket named after a domain, like the buckets custom domains
+// CNAME to c.storage.googleapis.com through. GCS only lets verified owners of the domain create
+// them, so they can't be claimed by someone else.
+func (b Bucket) domainNamed() bool {
+	return b.Provider == ProviderGCS && strings.Contains(b.Name, ".")
+}
+
+type bucketProvider struct {
+	name string
+	// Parse the bucket from a hostname and path. When the host was reached through a CNAME, alias
+	// is the original host, which S3 and GCS use as the bucket name for bare endpoint hosts.
+	parse func(host string, path string, alias string) (Bucket, bool)
+}
+
+var (
+	// Regions like "us-west-2" or "us-gov-west-1", and the legacy "external-1" endpoint
+	s3RegionPattern = `(?:[a-z]{2}(?:-[a-z]+)+-[0-9]+|external-1)`
+	// Only the real S3 endpoint forms, so bucket names starting with "s3-" aren't mistaken for an endpoint:
+	// s3, s3-<region>, s3.<region>, s3-website[.-]<region>, the fips, accelerate and dualstack variants,
+	// and the s3-1-w and s3-r-w.<region> hosts bucket CNAMEs resolve to
+	s3EndpointPattern = `(?:s3(?:-fips|-accelerate)?(?:\.dualstack)?(?:[.-]` + s3RegionPattern + `)?|s3-website[.-]` +
+		s3RegionPattern + `|s3-(?:[0-9]+|r)-w(?:\.` + s3RegionPattern + `)?)\.amazonaws\.com(?:\.cn)?`
+	s3PathStyleRegex       = regexp.MustCompile(`^` + s3EndpointPattern + `$`)
+	s3VirtualHostRegex     = regexp.MustCompile(`^(.+)\.(` + s3EndpointPattern + `)$`)
+	s3WebsiteEndpointRegex = regexp.MustCompile(`^s3-website[.-]`)
+	gcsPathStyleRegex      = regexp.MustCompile(`^(?:(?:c\.)?storage|commondatastorage)\.googleapis\.com$|^storage\.cloud\.google\.com$`)
+	gcsVirtualHostRegex    = regexp.MustCompile(`^(.+)\.storage\.googleapis\.com$`)
+	azureBlobRegex         = regexp.MustCompile(`^([a-z0-9]{3,24})\.blob\.core\.windows\.net$`)
+	spacesPathStyleRegex   = regexp.MustCompile(`^([a-z0-9]+)\.digitaloceanspaces\.com$`)
+	spacesVirtualHostRegex = regexp.MustCompile(`^([a-z0-9-]+)\.([a-z0-9]+)(?:\.cdn)?\.digitaloceanspaces\.com$`)
+	r2PathStyleRegex       = regexp.MustCompile(`^[a-f0-9]{32}\.r2\.cloudflarestorage\.com$`)
+	r2VirtualHostRegex     = regexp.MustCompile(`^([a-z0-9-]+)\.([a-f0-9]{32}\.r2\.cloudflarestorage\.com)$`)
+	r2PublicRegex          = regexp.MustCompile(`^pub-[a-f0-9]{32}\.r2\.dev$`)
+)
+
+var bucketProviders = []bucketProvider{
+	{name: ProviderS3, parse: parseS3Bucket},
+	{name: ProviderGCS, parse: parseGCSBucket},
+	{name: ProviderAzureBlob, parse: parseAzureBucket},
+	{name: ProviderSpaces, parse: parseSpacesBucket},
+	{name: ProviderCloudflareR2, parse: parseR2Bucket},
+}
+
+// Get the first segment of a URL path, which is the bucket name for path-style URLs.
+func firstPathSegment(path string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return segment
+}
+
+// Get the bucket name for a bare endpoint host, which is the alias when reached through a CNAME,
+// or the first path segment for path-style URLs.
+func pathStyleBucket(path string, alias string) string {
+	if alias != "" {
+		return alias
+	}
+	return firstPathSegment(path)
+}
+
+func parseS3Bucket(host string, path string, alias string) (Bucket, bool) {
+	bucket := Bucket{Provider: ProviderS3}
+	endpoint := host
+	// Virtual-hosted URLs are matched first, since the bucket name comes before a complete endpoint
+	if match := s3VirtualHostRegex.FindStringSubmatch(host); match != nil {
+		bucket.Name = match[1]
+		endpoint = match[2]
+	} else if s3PathStyleRegex.MatchString(host) {
+		bucket.Name = pathStyleBucket(path, alias)
+	} else {
+		return bucket, false
+	}
+
+	// Website endpoints don't support listing, so use the global REST endpoint instead
+	if s3WebsiteEndpointRegex.MatchString(endpoint) {
+		endpoint = "s3.amazonaws.com"
+	}
+
+	bucket.Endpoint = "https://" + endpoint
+	return bucket, true
+}
+
+func parseGCSBucket(host string, path string, alias string) (Bucket, bool) {
+	bucket := Bucket{Provider: ProviderGCS, Endpoint: "https://storage.googleapis.com"}
+	if gcsPathStyleRegex.MatchString(host) {
+		bucket.Name = pathStyleBucket(path, alias)
+	} else if match := gcsVirtualHostRegex.FindStringSubmatch(host); match != nil {
+		bucket.Name = match[1]
+	} else {
+		return bucket, false
+	}
+
+	return bucket, true
+}
+
+func parseAzureBucket(host string, path string, alias string) (Bucket, bool) {
+	match := azureBlobRegex.FindStringSubmatch(host)
+	if match == nil {
+		return Bucket{}, false
+	}
+
+	// Custom domains map to the storage account, so the path still has the container
+	return Bucket{
+		Provider:  ProviderAzureBlob,
+		Name:      match[1],
+		Container: firstPathSegment(path),
+		Endpoint:  "https://" + host,
+	}, true
+}
+
+func parseSpacesBucket(host string, path string, alias string) (Bucket, bool) {
+	bucket := Bucket{Provider: ProviderSpaces}
+	if match := spacesPathStyleRegex.FindStringSubmatch(host); match != nil {
+		bucket.Name = pathStyleBucket(path, alias)
+		bucket.Endpoint = "https://" + host
+	} else if match := spacesVirtualHostRegex.FindStringSubmatch(host); match != nil {
+		bucket.Name = match[1]
+		bucket.Endpoint = "https://" + match[2] + ".digitaloceanspaces.com"
+	} else {
+		return bucket, false
+	}
+
+	return bucket, true
+}
+
+func parseR2Bucket(host string, path string, alias string) (Bucket, bool) {
+	bucket := Bucket{Provider: ProviderCloudflareR2}
+	if r2PathStyleRegex.MatchString(host) {
+		bucket.Name = pathStyleBucket(path, alias)
+		bucket.Endpoint = "https://" + host
+	} else if match := r2VirtualHostRegex.FindStringSubmatch(host); match != nil {
+		bucket.Name = match[1]
+		bucket.Endpoint = "https://" + match[2]
+	} else if r2PublicRegex.MatchString(host) {
+		bucket.Endpoint = "https://" + host
+	} else {
+		return bucket, false
+	}
+
+	return bucket, true
+}
+
+// Find the cloud storage bucket a URL points to, either through its own host and path, or through
+// the hosts in its CNAME chain. Unlike matchFingerprint, earlier hosts in the chain are checked first,
+// since the first storage host in the chain names the bucket and later ones are the provider's own aliases.
+func findBucket(url *URL.URL, chain []string) (Bucket, bool) {
+	host := strings.ToLower(url.Hostname())
+	for _, provider := range bucketProviders {
+		bucket, ok := provider.parse(host, url.Path, "")
+		// Public r2.dev hosts are the only bucket URLs without a bucket name
+		if ok && (bucket.Name != "" || r2PublicRegex.MatchString(host)) {
+			return bucket, true
+		}
+	}
+
+	for i := 1; i < len(chain); i++ {
+		for _, provider := range bucketProviders {
+			if bucket, ok := provider.parse(chain[i], url.Path, host); ok {
+				return bucket, true
+			}
+		}
+	}
+
+	return Bucket{}, false
+}
+
+// Error response of the S3 XML API, which Azure also uses with its own codes.
+type bucketError struct {
+	Code string `xml:"Code"`
+}
+
+// Decide the state of a bucket from the response to listing it. S3, GCS, Spaces and R2 share
+// the S3 XML API, while Azure uses its own error codes. Listings are checked first, since
+// object keys in a listing can contain anything, including error codes. Only the provider's
+// code for a missing bucket means it doesn't exist: Azure also answers 404 ResourceNotFound
+// for private containers, so other 404s are treated as private.
+func classifyBucketResponse(provider string, res *http.Response, body []byte) BucketState {
+	content := string(body)
+	if res.StatusCode == http.StatusOK &&
+		(strings.Contains(content, "<ListBucketResult") || strings.Contains(content, "<EnumerationResults")) {
+		return BucketPublicListable
+	}
+
+	var bucketErr bucketError
+	xml.Unmarshal(body, &bucketErr)
+
+	code := bucketErr.Code
+	missingCode := "NoSuchBucket"
+	if provider == ProviderAzureBlob {
+		// Azure also sends the code in a header, which is set even when the body is empty
+		if header := res.Header.Get("x-ms-error-code"); header != "" {
+			code = header
+		}
+		missingCode = "ContainerNotFound"
+	}
+
+	if code == missingCode {
+		return BucketNonexistent
+	}
+
+	// Access denied, wrong region redirects and other errors all mean the bucket exists
+	return BucketPrivate
+}
+
+// Check the state of a bucket by resolving its endpoint and anonymously listing it.
+// The bucket's State and Claimable fields are set from the result.
+func checkBucket(ctx context.Context, bucket *Bucket, client *http.Client, resolver Resolver) error {
+	endpoint, err := URL.Parse(bucket.Endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to parse bucket endpoint %s: %v", bucket.Endpoint, err)
+	}
+
+	// Azure storage accounts only have DNS records while they exist
+	if net.ParseIP(endpoint.Hostname()) == nil {
+		nxdomain, err := checkNXDomain(ctx, endpoint.Hostname(), resolver)
+		if err != nil {
+			return fmt.Errorf("failed to resolve bucket endpoint %s: %w", endpoint.Hostname(), err)
+		}
+
+		if nxdomain {
+			bucket.State = BucketNonexistent
+			bucket.Claimable = bucket.Provider != ProviderCloudflareR2 && !bucket.domainNamed()
+			return nil
+		}
+	}
+
+	url := bucket.listURL()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to GET %s: %w", url, err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxBucketResponseSize))
+	if err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+
+	bucket.Status = res.StatusCode
+	bucket.State = classifyBucketResponse(bucket.Provider, res, body)
+
+	// R2 bucket names are scoped to a Cloudflare account, and a missing Azure container can only be
+	// recreated by the owner of the storage account, so neither can be claimed by someone else
+	bucket.Claimable = bucket.State == BucketNonexistent &&
+		bucket.Provider != ProviderCloudflareR2 &&
+		bucket.Provider != ProviderAzureBlob &&
+		!bucket.domainNamed()
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestFindBucket(t *testing.T) {
+	r2Account := "0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		rawURL    string
+		chain     []string
+		ok        bool
+		provider  string
+		name      string
+		container string
+		endpoint  string
+	}{
+		{"https://acme-assets.s3.amazonaws.com/js/app.js", nil, true, ProviderS3, "acme-assets", "", "https://s3.amazonaws.com"},
+		{"https://acme.assets.s3.us-west-2.amazonaws.com", nil, true, ProviderS3, "acme.assets", "", "https://s3.us-west-2.amazonaws.com"},
+		{"https://acme-assets.s3-eu-west-1.amazonaws.com", nil, true, ProviderS3, "acme-assets", "", "https://s3-eu-west-1.amazonaws.com"},
+		{"http://acme-assets.s3-website-us-east-1.amazonaws.com", nil, true, ProviderS3, "acme-assets", "", "https://s3.amazonaws.com"},
+		{"https://s3.amazonaws.com/acme-assets/js/app.js", nil, true, ProviderS3, "acme-assets", "", "https://s3.amazonaws.com"},
+		{"https://s3.eu-central-1.amazonaws.com/acme-assets", nil, true, ProviderS3, "acme-assets", "", "https://s3.eu-central-1.amazonaws.com"},
+		{"https://s3.amazonaws.com", nil, false, "", "", "", ""},
+		{"https://s3.dualstack.us-east-1.amazonaws.com/acme-assets", nil, true, ProviderS3, "acme-assets", "", "https://s3.dualstack.us-east-1.amazonaws.com"},
+		{"https://s3.cn-north-1.amazonaws.com.cn/acme-assets", nil, true, ProviderS3, "acme-assets", "", "https://s3.cn-north-1.amazonaws.com.cn"},
+		// Bucket names starting with "s3-" aren't part of the endpoint
+		{"https://s3-static-assets.s3.amazonaws.com/js/app.js", nil, true, ProviderS3, "s3-static-assets", "", "https://s3.amazonaws.com"},
+		{"https://s3-static-assets.s3.us-west-2.amazonaws.com/js/app.js", nil, true, ProviderS3, "s3-static-assets", "", "https://s3.us-west-2.amazonaws.com"},
+		{"https://s3-static-assets.s3-eu-west-1.amazonaws.com", nil, true, ProviderS3, "s3-static-assets", "", "https://s3-eu-west-1.amazonaws.com"},
+		{"https://s3-static-assets.amazonaws.com/js/app.js", nil, false, "", "", "", ""},
+		{"https://assets.acme.com/app.js", []string{"assets.acme.com", "s3-r-w.us-west-2.amazonaws.com"}, true, ProviderS3, "assets.acme.com", "", "https://s3-r-w.us-west-2.amazonaws.com"},
+		{"https://storage.googleapis.com/acme-assets/app.js", nil, true, ProviderGCS, "acme-assets", "", "https://storage.googleapis.com"},
+		{"https://acme-assets.storage.googleapis.com", nil, true, ProviderGCS, "acme-assets", "", "https://storage.googleapis.com"},
+		{"https://acmeassets.blob.core.windows.net/static/app.js", nil, true, ProviderAzureBlob, "acmeassets", "static", "https://acmeassets.blob.core.windows.net"},
+		{"https://acme-assets.nyc3.digitaloceanspaces.com", nil, true, ProviderSpaces, "acme-assets", "", "https://nyc3.digitaloceanspaces.com"},
+		{"https://acme-assets.nyc3.cdn.digitaloceanspaces.com", nil, true, ProviderSpaces, "acme-assets", "", "https://nyc3.digitaloceanspaces.com"},
+		{"https://ams3.digitaloceanspaces.com/acme-assets", nil, true, ProviderSpaces, "acme-assets", "", "https://ams3.digitaloceanspaces.com"},
+		{"https://acme-assets." + r2Account + ".r2.cloudflarestorage.com", nil, true, ProviderCloudflareR2, "acme-assets", "", "https://" + r2Account + ".r2.cloudflarestorage.com"},
+		{"https://pub-" + r2Account + ".r2.dev", nil, true, ProviderCloudflareR2, "", "", "https://pub-" + r2Account + ".r2.dev"},
+		{"https://example.com/s3.amazonaws.com", nil, false, "", "", "", ""},
+		// CNAMEs to a bucket name the bucket through the first storage host in the chain
+		{"https://assets.acme.com/app.js", []string{"assets.acme.com", "acme-assets.s3.amazonaws.com", "s3-1-w.amazonaws.com"}, true, ProviderS3, "acme-assets", "", "https://s3.amazonaws.com"},
+		// CNAMEs to a bare endpoint use the host as the bucket name
+		{"https://assets.acme.com/app.js", []string{"assets.acme.com", "s3-website-us-east-1.amazonaws.com"}, true, ProviderS3, "assets.acme.com", "", "https://s3.amazonaws.com"},
+		// GCS buckets for custom domains are named after the domain, which only its owner can create
+		{"https://assets.acme.com/app.js", []string{"assets.acme.com", "c.storage.googleapis.com"}, true, ProviderGCS, "assets.acme.com", "", "https://storage.googleapis.com"},
+		{"https://assets.acme.com/static/app.js", []string{"assets.acme.com", "acmeassets.blob.core.windows.net"}, true, ProviderAzureBlob, "acmeassets", "static", "https://acmeassets.blob.core.windows.net"},
+		{"https://assets.acme.com/app.js", []string{"assets.acme.com", "acme.herokuapp.com"}, false, "", "", "", ""},
+	}
+
+	for _, test := range tests {
+		parsedURL, err := url.Parse(test.rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		bucket, ok := findBucket(parsedURL, test.chain)
+		if ok != test.ok {
+			t.Errorf("%s: expected ok=%v, got %v", test.rawURL, test.ok, ok)
+			continue
+		}
+
+		if bucket.Provider != test.provider || bucket.Name != test.name || bucket.Container != test.container || bucket.Endpoint != test.endpoint {
+			t.Errorf("%s: unexpected bucket %+v", test.rawURL, bucket)
+		}
+	}
+}
+
+func TestCheckBucket(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing/", "/assets.acme.com/":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>NoSuchBucket</Code></Error>"))
+		case "/listing/":
+			// Object keys can contain error codes, which don't make a listing nonexistent
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`<ListBucketResult><Name>listing</Name><Contents><Key>docs/NoSuchBucket.html</Key></Contents></ListBucketResult>`))
+		case "/public/":
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`<ListBucketResult xmlns="http://s3.amazonaws.com/doc/2006-03-01/"><Name>public</Name></ListBucketResult>`))
+		case "/static":
+			w.Header().Set("x-ms-error-code", "ContainerNotFound")
+			w.WriteHeader(http.StatusNotFound)
+		case "/private":
+			// Azure hides private containers from anonymous requests behind a generic 404
+			w.Header().Set("x-ms-error-code", "ResourceNotFound")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>ResourceNotFound</Code><Message>The specified resource does not exist.</Message></Error>"))
+		case "/gone/":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("<Error><Code>AccessDenied</Code></Error>"))
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		bucket    Bucket
+		state     BucketState
+		claimable bool
+	}{
+		{Bucket{Provider: ProviderS3, Name: "missing"}, BucketNonexistent, true},
+		{Bucket{Provider: ProviderGCS, Name: "public"}, BucketPublicListable, false},
+		{Bucket{Provider: ProviderS3, Name: "listing"}, BucketPublicListable, false},
+		{Bucket{Provider: ProviderGCS, Name: "missing"}, BucketNonexistent, true},
+		{Bucket{Provider: ProviderGCS, Name: "assets.acme.com"}, BucketNonexistent, false},
+		{Bucket{Provider: ProviderSpaces, Name: "private"}, BucketPrivate, false},
+		{Bucket{Provider: ProviderCloudflareR2, Name: "missing"}, BucketNonexistent, false},
+		{Bucket{Provider: ProviderAzureBlob, Name: "acmeassets", Container: "static"}, BucketNonexistent, false},
+		{Bucket{Provider: ProviderAzureBlob, Name: "acmeassets", Container: "private"}, BucketPrivate, false},
+		{Bucket{Provider: ProviderS3, Name: "gone"}, BucketPrivate, false},
+	}
+
+	for _, test := range tests {
+		bucket := test.bucket
+		bucket.Endpoint = server.URL
+
+		err := checkBucket(context.Background(), &bucket, http.DefaultClient, fakeResolver{})
+		if err != nil {
+			t.Error(err)
+		}
+
+		if bucket.State != test.state || bucket.Claimable != test.claimable {
+			t.Errorf("%s %s: expected %s (claimable %v), got %s (claimable %v)",
+				bucket.Provider, bucket.Name, test.state, test.claimable, bucket.State, bucket.Claimable)
+		}
+	}
+}
+
+func TestCheckURLBucket(t *testing.T) {
+	// Storage accounts that were deleted no longer resolve, and can be registered by anyone
+	check, err := CheckURL(context.Background(), "https://acmeassets.blob.core.windows.net/static/app.js", nil, http.DefaultClient, fakeResolver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !check.Vulnerable || check.Service != ProviderAzureBlob || check.Bucket == nil || check.Bucket.State != BucketNonexistent {
+		t.Errorf("expected claimable Azure storage account, got %+v", check)
+	}
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	URL "net/url"
+	"strings"
+	"sync"
+)
+
+// A check that is running or done. done is closed once check and err are set.
+type checkEntry struct {
+	done  chan struct{}
+	check Check
+	err   error
+}
+
+// A CNAME chain lookup that is running or done. done is closed once chain and err are set.
+type chainEntry struct {
+	done  chan struct{}
+	chain []string
+	err   error
+}
+
+// Caches CheckURL verdicts by secondary origin or bucket, so a source shared by many primary URLs
+// is only checked once. Safe for concurrent use: callers asking for a key that is already being
+// checked wait for that check to finish instead of starting their own. CNAME chains are cached by
+// host too, since they are needed to find the bucket a custom domain serves before the key is known.
+type checkCache struct {
+	mu      sync.Mutex
+	entries map[string]*checkEntry
+	chains  map[string]*chainEntry
+}
+
+func newCheckCache() *checkCache {
+	return &checkCache{entries: map[string]*checkEntry{}, chains: map[string]*chainEntry{}}
+}
+
+// Get the cache key for a secondary URL whose host resolves to the CNAME chain. Bucket URLs are
+// keyed on the provider and bucket, since path-style URLs and custom domains share a host between
+// buckets, and everything else is keyed on the scheme, host and port.
+func checkCacheKey(url *URL.URL, chain []string) string {
+	if bucket, ok := findBucket(url, chain); ok {
+		return strings.Join([]string{bucket.Provider, bucket.Endpoint, bucket.Name, bucket.Container}, "|")
+	}
+
+	scheme := strings.ToLower(url.Scheme)
+	port := url.Port()
+	if port == "" {
+		port = defaultPort(scheme)
+	}
+
+	return strings.Join([]string{scheme, strings.TrimSuffix(strings.ToLower(url.Hostname()), "."), port}, "|")
+}
+
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	default:
+		return ""
+	}
+}
+
+// Resolve the CNAME chain for a host with resolveCNAMEChain, or return the chain already found for it.
+func (c *checkCache) resolveCNAMEChain(ctx context.Context, host string, resolver Resolver) ([]string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	c.mu.Lock()
+	entry, ok := c.chains[host]
+	if !ok {
+		entry = &chainEntry{done: make(chan struct{})}
+		c.chains[host] = entry
+	}
+	c.mu.Unlock()
+
+	if ok {
+		<-entry.done
+		return entry.chain, entry.err
+	}
+
+	entry.chain, entry.err = resolveCNAMEChain(ctx, host, resolver)
+	close(entry.done)
+	return entry.chain, entry.err
+}
+
+// Check the URL with CheckURL, or return the verdict for a URL with the same key.
+func (c *checkCache) CheckURL(ctx context.Context, rawURL string, fingerprints []Fingerprint, client *http.Client, resolver Resolver) (Check, error) {
+	url, err := URL.Parse(rawURL)
+	if err != nil {
+		return Check{}, fmt.Errorf("failed to parse URL %s: %w", rawURL, err)
+	}
+
+	chain, err := c.resolveCNAMEChain(ctx, url.Hostname(), resolver)
+	if err != nil {
+		return Check{CNAMEChain: chain}, err
+	}
+
+	key := checkCacheKey(url, chain)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &checkEntry{done: make(chan struct{})}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	if ok {
+		<-entry.done
+		return entry.check, entry.err
+	}
+
+	entry.check, entry.err = checkResolvedURL(ctx, rawURL, url, chain, fingerprints, client, resolver)
+	close(entry.done)
+	return entry.check, entry.err
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckCacheKey(t *testing.T) {
+	azure := []string{"assets.acme.com", "acmeassets.blob.core.windows.net"}
+
+	tests := []struct {
+		a, b  string
+		chain []string
+		same  bool
+	}{
+		{"https://cdn.acme.com/a.js", "https://CDN.acme.com./b.js", nil, true},
+		{"https://cdn.acme.com/a.js", "https://img.acme.com/a.js", nil, false},
+		{"https://cdn.acme.com/a.js", "https://cdn.acme.com:443/b.js", nil, true},
+		{"https://cdn.acme.com/a.js", "http://cdn.acme.com/a.js", nil, false},
+		{"https://cdn.acme.com/a.js", "https://cdn.acme.com:8443/a.js", nil, false},
+		{"https://s3.amazonaws.com/assets/a.js", "https://s3.amazonaws.com/assets/b.js", nil, true},
+		{"https://s3.amazonaws.com/assets/a.js", "https://s3.amazonaws.com/other/a.js", nil, false},
+		{"https://assets.s3.amazonaws.com/a.js", "https://assets.s3.amazonaws.com/b.js", nil, true},
+		// Custom domains in front of a storage account serve a container per path
+		{"https://assets.acme.com/static/a.js", "https://assets.acme.com/static/b.js", azure, true},
+		{"https://assets.acme.com/static/a.js", "https://assets.acme.com/media/a.js", azure, false},
+	}
+
+	for _, test := range tests {
+		a, err := url.Parse(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := url.Parse(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := checkCacheKey(a, test.chain) == checkCacheKey(b, test.chain)
+		if got != test.same {
+			t.Errorf("%s and %s: expected same key %v, got %v", test.a, test.b, test.same, got)
+		}
+	}
+}
+
+func TestCheckCacheResolvesCNAMEs(t *testing.T) {
+	resolver := fakeResolver{cnames: map[string]string{"assets.acme.com": "acmeassets.blob.core.windows.net"}}
+	cache := newCheckCache()
+
+	// The storage account doesn't resolve, so both containers are claimable, but each is its own verdict
+	for _, container := range []string{"static", "media"} {
+		check, err := cache.CheckURL(context.Background(), "https://assets.acme.com/"+container+"/app.js", nil, http.DefaultClient, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if check.Bucket == nil || check.Bucket.Container != container {
+			t.Errorf("expected the verdict for container %s, got %+v", container, check.Bucket)
+		}
+	}
+}
+
+func TestProcessSecondaryURLsDeduplicates(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("There isn't a site here"))
+	}))
+	defer server.Close()
+
+	parsedURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprints := []Fingerprint{{
+		Cname:       []string{parsedURL.Hostname()},
+		Fingerprint: "There isn't a site here",
+		Service:     "Example",
+		Vulnerable:  true,
+	}}
+
+	primaries := []string{"https://a.acme.com", "https://b.acme.com", "https://c.acme.com"}
+	urlsChannel := make(chan Result)
+	resultsChannel := make(chan Result)
+
+	go func() {
+		for _, primary := range primaries {
+			urlsChannel <- Result{PrimaryURL: primary, SecondaryURL: server.URL + "/app.js", Directive: "script-src"}
+			urlsChannel <- Result{PrimaryURL: primary, SecondaryURL: server.URL + "/app.css", Directive: "style-src"}
+		}
+		close(urlsChannel)
+	}()
+
+	go ProcessSecondaryURLs(context.Background(), urlsChannel, resultsChannel, 0, http.DefaultClient, NewSystemResolver(), fingerprints)
+
+	count := 0
+	for result := range resultsChannel {
+		count++
+		if result.Error != nil {
+			t.Error(result.Error)
+		}
+		if !result.Vulnerable || result.Service != "Example" {
+			t.Errorf("expected the verdict for %s to fan out to %s", result.SecondaryURL, result.PrimaryURL)
+		}
+	}
+
+	if count != len(primaries)*2 {
+		t.Errorf("expected %d results, got %d", len(primaries)*2, count)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("expected the shared host to be checked once, got %d requests", requests.Load())
+	}
+}
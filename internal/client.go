@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	URL "net/url"
+	"os"
+	"time"
+)
+
+// User-Agent sent with every request, unless ClientOptions.UserAgent is set
+const DefaultUserAgent = "cspscan"
+
+// Default for the maximum number of redirects followed, the same as the net/http default
+const DefaultMaxRedirects = 10
+
+// How the HTTP client connects and what it sends. Zero timeouts mean no timeout.
+type ClientOptions struct {
+	// Time to open a connection, including the TLS handshake
+	ConnectTimeout time.Duration
+	// Time to wait for the response headers once the request is sent
+	ReadTimeout time.Duration
+	// Time for each request sent, including reading the response body. Every retry and redirect
+	// gets its own, and time spent waiting for the rate limiter or between retries doesn't count.
+	Timeout time.Duration
+	// HTTP, HTTPS or SOCKS5 proxy URL, like http://127.0.0.1:8080. Defaults to the HTTP_PROXY
+	// and HTTPS_PROXY environment variables.
+	Proxy string
+	// PEM file of CA certificates to trust, on top of the system ones
+	CACert string
+	// Skip verifying TLS certificates
+	Insecure bool
+	// User-Agent sent with every request, or DefaultUserAgent if empty
+	UserAgent string
+	// Redirects followed before using the last response, 0 to never follow redirects
+	MaxRedirects int
+}
+
+// Build the transport for the options, without the client level MaxRedirects. The Timeout is applied
+// here rather than by the client, so a rate limiter or retries wrapped around the transport don't eat into it.
+func NewTransport(options ClientOptions) (http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{Timeout: options.ConnectTimeout, KeepAlive: 30 * time.Second}
+	transport.DialContext = dialer.DialContext
+	transport.TLSHandshakeTimeout = options.ConnectTimeout
+	transport.ResponseHeaderTimeout = options.ReadTimeout
+
+	if options.Proxy != "" {
+		proxy, err := URL.Parse(options.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %s: %w", options.Proxy, err)
+		}
+		switch proxy.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("invalid proxy %s: scheme must be http, https, socks5 or socks5h", options.Proxy)
+		}
+		if proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %s: missing host", options.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.Insecure}
+	if options.CACert != "" {
+		pem, err := os.ReadFile(options.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", options.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	userAgent := options.UserAgent
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+
+	var base http.RoundTripper = transport
+	if options.Timeout > 0 {
+		base = &timeoutTransport{base: transport, timeout: options.Timeout}
+	}
+	return &userAgentTransport{base: base, userAgent: userAgent}, nil
+}
+
+// Build a client that sends requests with transport, with the options' MaxRedirects.
+// transport is usually NewTransport(options), wrapped in the rate limiter and retries.
+func NewClient(transport http.RoundTripper, options ClientOptions) *http.Client {
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: maxRedirects(options.MaxRedirects),
+	}
+}
+
+// Follow up to max redirects, then use the last response rather than failing, so its CSP can still be read.
+func maxRedirects(max int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+}
+
+// Sets the User-Agent of every request that doesn't already have one.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the request
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
+
+// Gives every request its own deadline, which lasts until the response body is closed.
+type timeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	res, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, options ClientOptions) *http.Client {
+	t.Helper()
+	transport, err := NewTransport(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewClient(transport, options)
+}
+
+func TestClientUserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+
+	for _, test := range []struct{ option, expected string }{{"", DefaultUserAgent}, {"scanner/1.0", "scanner/1.0"}} {
+		client := newTestClient(t, ClientOptions{UserAgent: test.option})
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if userAgent != test.expected {
+			t.Errorf("expected User-Agent %q, got %q", test.expected, userAgent)
+		}
+	}
+}
+
+func TestClientMaxRedirects(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hop int
+		fmt.Sscanf(r.URL.Path, "/%d", &hop)
+		http.Redirect(w, r, fmt.Sprintf("/%d", hop+1), http.StatusFound)
+	}))
+	defer server.Close()
+
+	for _, max := range []int{0, 1, 3} {
+		client := newTestClient(t, ClientOptions{MaxRedirects: max})
+		res, err := client.Get(server.URL + "/0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		// The last response is used, rather than an error
+		if expected := fmt.Sprintf("/%d", max); res.Request.URL.Path != expected || res.StatusCode != http.StatusFound {
+			t.Errorf("expected to stop at %s with max %d, stopped at %s with %d", expected, max, res.Request.URL.Path, res.StatusCode)
+		}
+	}
+}
+
+func TestClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+
+	client := newTestClient(t, ClientOptions{Proxy: proxy.URL})
+	res, err := client.Get("http://target.example.com/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if proxied != "http://target.example.com/page" {
+		t.Errorf("expected the request to go through the proxy, got %q", proxied)
+	}
+}
+
+func TestNewTransportInvalidProxy(t *testing.T) {
+	for _, proxy := range []string{"ftp://127.0.0.1:21", "http://", "%"} {
+		if _, err := NewTransport(ClientOptions{Proxy: proxy}); err == nil {
+			t.Errorf("expected an error for proxy %q", proxy)
+		}
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	get := func(options ClientOptions) error {
+		res, err := newTestClient(t, options).Get(server.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	if err := get(ClientOptions{}); err == nil || classifyError(err) != ErrorTLS {
+		t.Errorf("expected a TLS error for an untrusted certificate, got %v", err)
+	}
+
+	if err := get(ClientOptions{Insecure: true}); err != nil {
+		t.Errorf("expected --insecure to skip verification, got %v", err)
+	}
+
+	caCert := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caCert, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(ClientOptions{CACert: caCert}); err != nil {
+		t.Errorf("expected the CA bundle to be trusted, got %v", err)
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTransport(ClientOptions{CACert: empty}); err == nil || !strings.Contains(err.Error(), "no PEM certificates") {
+		t.Errorf("expected an error for a file without certificates, got %v", err)
+	}
+}
+
+func TestClientReadTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := newTestClient(t, ClientOptions{ReadTimeout: 20 * time.Millisecond})
+	_, err := client.Get(server.URL)
+	if err == nil {
+		t.Fatal("expected a read timeout")
+	}
+	if classifyError(err) != ErrorTimeout {
+		t.Errorf("expected a timeout error, got %s: %v", classifyError(err), err)
+	}
+
+	// A read timeout is a single slow attempt, so it is retried
+	if !isRetryableError(err) {
+		t.Errorf("expected a read timeout to be retryable, got %v", err)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.Write([]byte("done"))
+	}))
+	defer server.Close()
+
+	options := ClientOptions{Timeout: 50 * time.Millisecond}
+	transport, err := NewTransport(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Waiting 200ms for the rate limiter doesn't count against the timeout
+	limiter := NewRateLimiter(RateLimitOptions{HostRPS: 5})
+	client := NewClient(limiter.Transport(transport), options)
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("expected request %d to not time out while rate limited: %v", i, err)
+		}
+		io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	// Reading the body does
+	res, err := client.Get(server.URL + "/slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if _, err := io.ReadAll(res.Body); classifyError(err) != ErrorTimeout {
+		t.Errorf("expected reading a slow body to time out, got %v", err)
+	}
+}
@@ -1,14 +1,46 @@
 package internal
 
 import (
+	"context"
 	"net/http"
+	URL "net/url"
+	"strings"
 	"sync"
 )
 
 type Result struct {
 	PrimaryURL    string
 	SecondaryURL  string
+	// Directive the secondary URL appeared in, like "script-src"
+	Directive string
+	// Header the secondary URL's policy was delivered in
+	Header string
+	// The secondary URL's policy is only reported on, not enforced
+	ReportOnly bool
+	// How the secondary URL's policy was delivered, either DeliveryHeader or DeliveryMeta
+	Delivery string
+	// The full policy the secondary URL appeared in, shared by every result from the same policy
+	Policy *Policy
+	// URLs the secondary URL was found through, from the primary URL to the secondary URL. Sources found
+	// on followed pages have the pages in between.
+	Chain []string
 	Vulnerable   bool
+	// Service of the matched fingerprint or bucket provider
+	Service string
+	// Set if the secondary URL is a cloud storage bucket
+	Bucket *Bucket
+	// Severity of the finding, or SeverityNone if it isn't vulnerable
+	Severity Severity
+	// What the verdict was based on, like the CNAME chain and the matched response
+	Evidence []string
+	// CNAME chain of the secondary URL's host, starting with the host itself
+	CNAMEChain []string
+	// Status code of the response the verdict was based on, or 0 if no request was sent
+	HTTPStatus int
+	// Most attempts any request for the result took, counting retries, or 0 if no request was sent
+	Attempts int
+	// Set if the URL couldn't be scanned, as a *ScanError. Results for primary URLs that
+	// failed have no SecondaryURL.
 	Error error
 }
 
@@ -16,107 +48,299 @@ func (r Result) IsSameAs(other Result) bool {
 	return r.PrimaryURL == other.PrimaryURL &&
 		r.SecondaryURL == other.SecondaryURL &&
 		r.Vulnerable == other.Vulnerable &&
+		r.Service == other.Service &&
+		r.Severity == other.Severity &&
 		r.Error == other.Error
 }
 
+// Verdicts for a result
+const (
+	VerdictVulnerable    = "vulnerable"
+	VerdictNotVulnerable = "not-vulnerable"
+	VerdictError         = "error"
+)
+
+// Get the verdict for the result, either VerdictVulnerable, VerdictNotVulnerable or VerdictError.
+func (r Result) Verdict() string {
+	switch {
+	case r.Error != nil:
+		return VerdictError
+	case r.Vulnerable:
+		return VerdictVulnerable
+	default:
+		return VerdictNotVulnerable
+	}
+}
+
+// Get the followed pages between the primary and secondary URL, or nil if the secondary URL was
+// found on the primary URL itself.
+func (r Result) Via() []string {
+	if len(r.Chain) < 3 {
+		return nil
+	}
+	return r.Chain[1 : len(r.Chain)-1]
+}
+
+// Get the host at the end of the secondary URL's CNAME chain, or an empty string if it has no CNAME.
+func (r Result) CNAMETarget() string {
+	if len(r.CNAMEChain) < 2 {
+		return ""
+	}
+	return r.CNAMEChain[len(r.CNAMEChain)-1]
+}
+
+// A page to fetch the CSP of in ProcessPrimaryURLs.
+type primaryJob struct {
+	url string
+	// URLs the page was found through, starting with the input target and ending with the page itself
+	chain []string
+	depth int
+}
+
+// Check if a URL's host already appears in a discovery chain.
+func chainHasHost(chain []string, url string) bool {
+	host := urlHost(url)
+	for _, link := range chain {
+		if urlHost(link) == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the lowercase host and port of a URL, or the URL itself if it can't be parsed.
+func urlHost(rawURL string) string {
+	url, err := URL.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return strings.ToLower(url.Host)
+}
 
-// Create threadLimit (or len(input) many threads if threadLimit is 0) to concurrently run GetCSP() from csp.go.
+// Default number of workers for each stage, used when the number of workers is 0
+const (
+	DefaultPrimaryWorkers = 100
+	DefaultCheckWorkers   = 200
+)
+
+// Start a fixed pool of workers (or DefaultPrimaryWorkers if workers is 0) to concurrently run GetCSP() from csp.go.
+// URLs are read from input as they come in, until it is closed, and reading blocks while every worker is busy.
 // Results are stored in the urlsChan channel as a Result for each secondaryUrl found in the CSP.
+//
+// With a depth above 0, the CSPs of the secondary URLs are fetched too, up to depth levels below the
+// input URLs, and their sources are checked as if they were found on the input URL. Each host is only
+// followed once per scan, and never back into a host earlier in its own discovery chain.
+//
+// Cancelling ctx stops reading input and following pages, and aborts the requests in flight.
+// Pages whose requests were aborted have no results, since the scan didn't get to check them.
 func ProcessPrimaryURLs(
-	input []string, 
+	ctx context.Context,
+	input <-chan string, 
 	urlsChan chan<- Result, 
-	threadLimit int, 
+	workers int, 
 	client *http.Client,
+	options CSPOptions,
+	depth int,
 ) {
 	var wg sync.WaitGroup
 
-	if threadLimit == 0 {
-		threadLimit = len(input)
+	if workers == 0 {
+		workers = DefaultPrimaryWorkers
+	}
+
+	jobs := make(chan primaryJob)
+	// Pages found by the workers that can be followed, and workers that finished a job
+	followed := make(chan primaryJob)
+	finished := make(chan struct{})
+
+	// Fetch the page's CSP and send the pages to follow back to the dispatcher
+	process := func(job primaryJob) {
+		// Headers and cookies are for the input URLs, so they aren't sent to followed pages on other hosts
+		jobOptions := options
+		if job.depth > 0 && !options.AuthAllHosts {
+			jobOptions = options.withoutAuth()
+		}
+
+		jobCtx, attempts := withAttemptCounter(ctx)
+		policies, err := GetCSP(jobCtx, job.url, client, jobOptions)
+		if err != nil {
+			// Followed secondary URLs are often dead or not pages at all, so only input URLs report errors
+			if job.depth == 0 && ctx.Err() == nil {
+				urlsChan <- Result{
+					PrimaryURL: job.url,
+					Chain: job.chain,
+					Attempts: attempts.attempts(),
+					Error: newScanError(err),
+				}
+			}
+			return
+		}
+
+		for i := range policies {
+			policy := &policies[i]
+			for _, source := range policy.URLSources() {
+				secondaryUrl, _ := source.URL()
+				chain := append(append([]string{}, job.chain...), secondaryUrl)
+				urlsChan <- Result{
+					PrimaryURL: job.chain[0],
+					SecondaryURL: secondaryUrl,
+					Directive: source.Directive,
+					Header: policy.Header,
+					ReportOnly: policy.ReportOnly,
+					Delivery: policy.Delivery,
+					Policy: policy,
+					Chain: chain,
+				}
+
+				if job.depth < depth && !chainHasHost(job.chain, secondaryUrl) {
+					followed <- primaryJob{url: secondaryUrl, chain: chain, depth: job.depth + 1}
+				}
+			}
+		}
 	}
-	// Make a semaphore to limit the number of threads. 
-	// Struct{} is used since no memory is allocated and we only care about the buffer size.
-	sem := make(chan struct{}, threadLimit)
 
-	for _, url := range input {
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(url string) {
+		go func() {
 			defer wg.Done()
-			// Acquire semaphore. Sends an empty struct to the channel
-			// which will block this when we are at the thread limit.
-			sem <- struct{}{}
-
-			secondaryUrls, err := GetCSP(url, client)
-			if err != nil {
-				urlsChan <- Result{PrimaryURL: url, Error: err}
-				<-sem //Release semaphore when done, even if error is found
-				return
+			for job := range jobs {
+				process(job)
+				finished <- struct{}{}
 			}
+		}()
+	}
 
-			for _, secondaryUrl := range secondaryUrls {
-				urlsChan <- Result{PrimaryURL: url, SecondaryURL: secondaryUrl}
+	// Dispatch input URLs and followed pages to the workers. Followed pages are queued without
+	// blocking, so a worker sending one never waits on a busy pool, and go out before new input
+	// URLs are read. Only the dispatcher touches the queue and visited hosts, so they need no lock.
+	go func() {
+		defer close(jobs)
+
+		// Hosts that have already been fetched, so pages shared by many input URLs are only fetched once.
+		// Nothing is followed at depth 0, so input URLs aren't tracked then and the set is never allocated.
+		var visited map[string]bool
+		if depth > 0 {
+			visited = map[string]bool{}
+		}
+		visit := func(url string) bool {
+			if visited == nil {
+				return true
 			}
+			host := urlHost(url)
+			if visited[host] {
+				return false
+			}
+			visited[host] = true
+			return true
+		}
 
-			<-sem //Release semaphore
-		}(url)
-	}
+		var queue []primaryJob
+		active := 0
+		in, done := input, ctx.Done()
+		for in != nil || len(queue) > 0 || active > 0 {
+			var out chan<- primaryJob
+			var next primaryJob
+			read := in
+			if len(queue) > 0 {
+				out, next = jobs, queue[0]
+				read = nil
+			}
+
+			select {
+			case url, ok := <-read:
+				if !ok {
+					in = nil
+					continue
+				}
+				visit(url)
+				queue = append(queue, primaryJob{url: url, chain: []string{url}})
+			case job := <-followed:
+				if ctx.Err() == nil && visit(job.url) {
+					queue = append(queue, job)
+				}
+			case out <- next:
+				queue = queue[1:]
+				active++
+			case <-finished:
+				active--
+			case <-done:
+				// Stop reading input and drop the queued pages, but let the workers finish
+				in, done, queue = nil, nil, nil
+			}
+		}
+	}()
 
 	wg.Wait()
 	close(urlsChan)
 }
 
-// Create threadLimit (or 1000 threads if threadLimit is 0) to concurrently run CheckURL() from subdomain_takeover.go.
+// Start a fixed pool of workers (or DefaultCheckWorkers if workers is 0) to concurrently run CheckURL() from subdomain_takeover.go.
+// Each secondary host or bucket is only checked once, and its verdict is used for every primary URL it was found on.
 // Results are stored in the resultsChan channel.
+//
+// Cancelling ctx skips the URLs that haven't been checked yet, and aborts the checks in flight.
+// urlsChan is still read until it is closed, so ProcessPrimaryURLs never blocks sending to it.
 func ProcessSecondaryURLs(
+	ctx context.Context,
 	urlsChan <-chan Result,
 	resultsChan chan<- Result,
-	threadLimit int,
+	workers int,
 	client *http.Client,
+	resolver Resolver,
 	fingerprints []Fingerprint,
 ) {
 	var wg sync.WaitGroup
 
-	if threadLimit == 0 {
-		threadLimit = 1000
+	if workers == 0 {
+		workers = DefaultCheckWorkers
 	}
 
-	// Make a semaphore to limit the number of threads. 
-	// Struct{} is used since no memory is allocated and we only care about the buffer size.
-	sem := make(chan struct{}, threadLimit)
+	cache := newCheckCache()
 
-	for result := range urlsChan {
+	check := func(result Result) {
+		// Pass failed primary URLs through, so they are counted with the rest of the results
 		if result.Error != nil {
-			continue
+			resultsChan <- result
+			return
+		}
+
+		if ctx.Err() != nil {
+			return // Skip without checking, since the scan is stopping
 		}
 
+		check, err := cache.CheckURL(ctx, result.SecondaryURL, fingerprints, client, resolver)
+		if err != nil && ctx.Err() != nil {
+			return // The check was aborted, so there is no verdict
+		}
+		result.Attempts = check.Attempts
+		if err != nil {
+			result.Error = newScanError(err)
+			resultsChan <- result
+			return
+		}
+
+		result.Vulnerable = check.Vulnerable
+		result.Service = check.Service
+		result.Bucket = check.Bucket
+		result.Evidence = check.Evidence
+		result.CNAMEChain = check.CNAMEChain
+		result.HTTPStatus = check.HTTPStatus
+		if check.Vulnerable {
+			result.Severity = scoreSeverity(result.Directive, result.ReportOnly, check.Confidence)
+		}
+		resultsChan <- result
+	}
+
+	for i := 0; i < workers; i++ {
 		wg.Add(1)
-		go func(result Result) {
+		go func() {
 			defer wg.Done()
-			// Acquire semaphore. Sends an empty struct to the channel
-			// which will block this when we are at the thread limit.
-			sem <- struct{}{}
-
-			vulnerable, err := CheckURL(result.SecondaryURL, fingerprints, client)
-			if err != nil {
-				resultsChan <- Result{
-					PrimaryURL: result.PrimaryURL, 
-					SecondaryURL: result.SecondaryURL, 
-					Vulnerable: false, 
-					Error: err,
-				}
-				<-sem //Release semaphore when done, even if error is found
-				return
+			for result := range urlsChan {
+				check(result)
 			}
-
-			resultsChan <- Result{
-				PrimaryURL: result.PrimaryURL, 
-				SecondaryURL: result.SecondaryURL, 
-				Vulnerable: vulnerable,
-			}
-
-			<-sem //Release semaphore
-		}(result)
+		}()
 	}
 
 	wg.Wait()
 	close(resultsChan)
-}
\ No newline at end of file
+}
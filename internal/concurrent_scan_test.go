@@ -1,12 +1,16 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // Helper function to keep TestIsSameAs from being massive
@@ -19,6 +23,18 @@ func result(primary, secondary string, vuln bool, err error) Result {
 	}
 }
 
+// Helper function to stream input URLs into ProcessPrimaryURLs
+func targets(urls []string) <-chan string {
+	input := make(chan string)
+	go func() {
+		for _, url := range urls {
+			input <- url
+		}
+		close(input)
+	}()
+	return input
+}
+
 func TestIsSameAs(t *testing.T) {
 	errA := fmt.Errorf("error A")
 	errB := fmt.Errorf("error B")
@@ -62,7 +78,7 @@ func TestProcessPrimaryURLs(t *testing.T) {
 	urlsChannel := make(chan Result)
 	client := http.DefaultClient
 
-	go ProcessPrimaryURLs([]string{server.URL}, urlsChannel, 0, client)
+	go ProcessPrimaryURLs(context.Background(), targets([]string{server.URL}), urlsChannel, 0, client, CSPOptions{}, 0)
 
 	var results []string
 	for result := range urlsChannel {
@@ -96,6 +112,8 @@ func TestProcessSecondaryURLs(t *testing.T) {
 		PrimaryURL: server.URL,
 		SecondaryURL: server.URL,
 		Vulnerable: true,
+		// No directive, so the finding has the lowest directive severity
+		Severity: SeverityLow,
 	}
 
 	parsedURL, err := url.Parse(server.URL)
@@ -104,7 +122,7 @@ func TestProcessSecondaryURLs(t *testing.T) {
 	}
 
 	exampleFingerprint := Fingerprint{
-		Cname: []string{parsedURL.Host},
+		Cname: []string{parsedURL.Hostname()},
 		Fingerprint: "test",
 		NXDomain: false,
 		Vulnerable: true,
@@ -119,7 +137,7 @@ func TestProcessSecondaryURLs(t *testing.T) {
 	resultsChannel := make(chan Result)
 	client := http.DefaultClient
 
-	go ProcessSecondaryURLs(urlsChannel, resultsChannel, 0, client, fingerprints)
+	go ProcessSecondaryURLs(context.Background(), urlsChannel, resultsChannel, 0, client, NewSystemResolver(), fingerprints)
 
 	for result := range resultsChannel {
 		if result.Error != nil {
@@ -157,8 +175,8 @@ func TestProcessPrimaryURLsBulk(t *testing.T) {
 		inputURLs[i] = server.URL
 	}
 
-	// Test with no thread limit
-	go ProcessPrimaryURLs(inputURLs, urlsChannel, 0, client)
+	// Test with the default number of workers
+	go ProcessPrimaryURLs(context.Background(), targets(inputURLs), urlsChannel, 0, client, CSPOptions{}, 0)
 
 	for result := range urlsChannel {
 		if result.Error != nil {
@@ -174,11 +192,11 @@ func TestProcessPrimaryURLsBulk(t *testing.T) {
 		t.Error("results did not match expected.")
 	}
 
-	// Test with thread limit (not URLCount many threads, since no limit should create up to that amount)
+	// Test with fewer workers than the default
 	urlsChannel2 := make(chan Result)
 	var results2 = make(map[string]int)
 
-	go ProcessPrimaryURLs(inputURLs, urlsChannel2, 10, client)
+	go ProcessPrimaryURLs(context.Background(), targets(inputURLs), urlsChannel2, 10, client, CSPOptions{}, 0)
 	
 	for result := range urlsChannel2 {
 		if result.Error != nil {
@@ -193,4 +211,145 @@ func TestProcessPrimaryURLsBulk(t *testing.T) {
 		t.Logf("Got %v\n", results2)
 		t.Error("results did not match expected.")
 	}
-}
\ No newline at end of file
+}
+func TestProcessPrimaryURLsDepth(t *testing.T) {
+	var hits sync.Map
+	newServer := func(name string, csp func() string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count, _ := hits.LoadOrStore(name, new(atomic.Int32))
+			count.(*atomic.Int32).Add(1)
+			w.Header().Set("Content-Security-Policy", csp())
+		}))
+	}
+
+	// a -> b -> c -> dangling, with b also pointing back at a
+	var a, b, c *httptest.Server
+	c = newServer("c", func() string { return "img-src https://dangling.example.com" })
+	defer c.Close()
+	b = newServer("b", func() string { return "script-src " + c.URL + " " + a.URL })
+	defer b.Close()
+	a = newServer("a", func() string { return "script-src " + b.URL })
+	defer a.Close()
+
+	scan := func(depth int) []Result {
+		urlsChannel := make(chan Result)
+		go ProcessPrimaryURLs(context.Background(), targets([]string{a.URL}), urlsChannel, 0, http.DefaultClient, CSPOptions{Method: MethodGet}, depth)
+
+		var results []Result
+		for result := range urlsChannel {
+			if result.Error != nil {
+				t.Error(result.Error)
+			}
+			results = append(results, result)
+		}
+		return results
+	}
+
+	if results := scan(0); len(results) != 1 || results[0].SecondaryURL != b.URL {
+		t.Errorf("expected only the input URL's sources without depth, got %+v", results)
+	}
+
+	hits = sync.Map{}
+	results := scan(2)
+	if len(results) != 4 {
+		t.Fatalf("expected 4 results, got %d: %+v", len(results), results)
+	}
+
+	var dangling *Result
+	for i := range results {
+		if results[i].PrimaryURL != a.URL {
+			t.Errorf("expected every result to keep the input URL as its primary URL, got %s", results[i].PrimaryURL)
+		}
+		if results[i].SecondaryURL == "https://dangling.example.com" {
+			dangling = &results[i]
+		}
+	}
+
+	if dangling == nil {
+		t.Fatal("expected the source two levels down to be found")
+	}
+	expectedChain := []string{a.URL, b.URL, c.URL, "https://dangling.example.com"}
+	if !reflect.DeepEqual(dangling.Chain, expectedChain) {
+		t.Errorf("expected chain %v, got %v", expectedChain, dangling.Chain)
+	}
+	if !reflect.DeepEqual(dangling.Via(), []string{b.URL, c.URL}) {
+		t.Errorf("expected via %v, got %v", []string{b.URL, c.URL}, dangling.Via())
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		count, ok := hits.Load(name)
+		if !ok || count.(*atomic.Int32).Load() != 1 {
+			t.Errorf("expected %s to be fetched once", name)
+		}
+	}
+}
+
+func TestProcessURLsCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// The input is never closed, so only cancelling can stop the stage
+	input := make(chan string)
+	urlsChannel := make(chan Result)
+	resultsChannel := make(chan Result)
+	go ProcessPrimaryURLs(ctx, input, urlsChannel, 0, http.DefaultClient, CSPOptions{Method: MethodGet}, 0)
+	go ProcessSecondaryURLs(ctx, urlsChannel, resultsChannel, 0, http.DefaultClient, fakeResolver{}, nil)
+
+	input <- server.URL
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for result := range resultsChannel {
+			t.Errorf("expected aborted requests to have no results, got %+v", result)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the stages to stop after cancelling")
+	}
+}
+
+func TestProcessPrimaryURLsWorkers(t *testing.T) {
+	const workers = 3
+	var active, maxActive atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := active.Add(1)
+		defer active.Add(-1)
+		for {
+			seen := maxActive.Load()
+			if current <= seen || maxActive.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	inputURLs := make([]string, 20)
+	for i := range inputURLs {
+		inputURLs[i] = server.URL
+	}
+
+	urlsChannel := make(chan Result)
+	go ProcessPrimaryURLs(context.Background(), targets(inputURLs), urlsChannel, workers, http.DefaultClient, CSPOptions{Method: MethodGet}, 0)
+	for result := range urlsChannel {
+		t.Errorf("expected no results for pages without a CSP, got %+v", result)
+	}
+
+	if maxActive.Load() > workers {
+		t.Errorf("expected at most %d requests at once, got %d", workers, maxActive.Load())
+	}
+}
@@ -1,82 +1,194 @@
 package internal
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net/http"
 	URL "net/url"
 	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Headers CSPs are delivered in
+const (
+	CSPHeader           = "Content-Security-Policy"
+	CSPReportOnlyHeader = "Content-Security-Policy-Report-Only"
+)
+
+// Mechanisms CSPs are delivered through
+const (
+	DeliveryHeader = "header"
+	DeliveryMeta   = "meta"
 )
 
-// Parse links out of a CSP. URLs that can't be parsed will be skipped.
-func parseCSP(res *http.Response) []string {
-	csp := res.Header.Get("Content-Security-Policy")
-	if csp == "" {
-		// Return a pointer to an empty string slice, rather than no pointer to indicate that no
-		// CSP was found, but the request was successful.
-		return []string{}
+// Maximum size of an HTML page that is read when looking for <meta> CSPs
+const maxHTMLSize = 2 << 20
+
+// Request methods GetCSP can use
+const (
+	// Send a HEAD request, falling back to GET if it fails, is rejected, or has no CSP
+	MethodAuto = "auto"
+	MethodHead = "head"
+	MethodGet  = "get"
+)
+
+// Options for how GetCSP finds a page's policies.
+type CSPOptions struct {
+	// GET the page and parse <meta http-equiv="Content-Security-Policy"> tags, along with the headers
+	HTML bool
+	// One of MethodAuto (default), MethodHead or MethodGet. HTML mode always uses GET.
+	Method string
+	// Headers added to requests for input URLs, like Authorization
+	Headers http.Header
+	// Cookies sent with requests for input URLs
+	Cookies []*http.Cookie
+	// Cookies sent to every page on the domains they match, like ones loaded with LoadCookieFile
+	CookieJar http.CookieJar
+	// Also send Headers and Cookies to followed pages and redirects on other hosts
+	AuthAllHosts bool
+}
+
+// Check that the options are valid, before any requests are sent.
+func (o CSPOptions) Validate() error {
+	switch strings.ToLower(o.Method) {
+	case "", MethodAuto, MethodHead, MethodGet:
+		return nil
+	default:
+		return fmt.Errorf("unknown method %q, expected one of auto, head or get", o.Method)
 	}
+}
 
-	var urls []string
-	directives := strings.Split(csp, ";")
+// Parse every CSP and CSP-Report-Only header in the response.
+func parseCSP(res *http.Response) []Policy {
+	// Return an empty slice rather than nil to indicate that no CSP was found,
+	// but the request was successful.
+	policies := []Policy{}
 
-	for _, directive := range directives {
-		sources := strings.Fields(directive)
-		if len(sources) < 2 {
-			continue // Skip if no sources after directive name
+	for _, header := range []string{CSPHeader, CSPReportOnlyHeader} {
+		// Each header can be sent more than once, and each value can hold a comma separated list of policies
+		for _, value := range res.Header.Values(header) {
+			for _, csp := range strings.Split(value, ",") {
+				policy := ParsePolicy(csp)
+				policy.Header = header
+				policy.ReportOnly = header == CSPReportOnlyHeader
+				policy.Delivery = DeliveryHeader
+				policies = append(policies, policy)
+			}
 		}
+	}
 
-		// Loop over sources (ignore the first entry, which is the directive name)
-		for _, source := range sources[1:] {
-			// Ignore CSP keywords and exact wildcard subdomains
-			if source == "'self'" || source == "'none'" || source == "*" {
-				continue
-			}
+	return policies
+}
 
-			// Remove wildcard port (":*") if present
-			source = strings.Replace(source, ":*", "", 1)
+// Parse CSPs delivered in <meta http-equiv="Content-Security-Policy"> tags. Only the document
+// head is read, since browsers ignore <meta> policies anywhere else. Report-only policies
+// can't be delivered in <meta> tags, so they are skipped like browsers do.
+func parseMetaCSP(body io.Reader) []Policy {
+	policies := []Policy{}
+	tokenizer := html.NewTokenizer(body)
 
-			// Add "http://" if no protocol to make it a valid URL
-			if !strings.Contains(source, "://") {
-				source = "https://" + source
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			// End of the document, or it was cut off at maxHTMLSize
+			return policies
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data == "body" {
+				return policies
 			}
 
-			// Parse the URL and clean up any wildcard ports (like ":*")
-			parsedURL, err := URL.Parse(source)
-			if err != nil || parsedURL.Host == "" {
+			if token.Data != "meta" {
 				continue
 			}
 
-			if !strings.Contains(parsedURL.Host, ".") {
-				continue // Skip if no TLD
+			var httpEquiv, content string
+			for _, attr := range token.Attr {
+				switch strings.ToLower(attr.Key) {
+				case "http-equiv":
+					httpEquiv = strings.TrimSpace(attr.Val)
+				case "content":
+					content = attr.Val
+				}
 			}
-			
-			// Ignore wildcard domains
-			if strings.HasPrefix(parsedURL.Host, "*.") {
+
+			if !strings.EqualFold(httpEquiv, CSPHeader) {
 				continue
 			}
 
-			// Add the URL to the list
-			urls = append(urls, parsedURL.String())
+			policy := ParsePolicy(content)
+			policy.Header = CSPHeader
+			policy.Delivery = DeliveryMeta
+			policies = append(policies, policy)
+		case html.EndTagToken:
+			if tokenizer.Token().Data == "head" {
+				return policies
+			}
 		}
 	}
+}
+
+// Send a single request and parse the policies from the response. The status code is returned
+// so GetCSP can decide whether to retry with a different method.
+func requestCSP(ctx context.Context, url string, method string, client *http.Client, options CSPOptions, parseHTML bool) ([]Policy, int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	options.authorize(req)
+
+	res, err := options.redirectClient(client).Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get CSP for %s: %w", url, err)
+	}
+	defer res.Body.Close()
 
-	return urls
+	out := parseCSP(res)
+	if parseHTML {
+		out = append(out, parseMetaCSP(io.LimitReader(res.Body, maxHTMLSize))...)
+	}
+
+	return out, res.StatusCode, nil
 }
 
-// Send a HEAD request and parse the links from the response.
-func GetCSP(rawURL string, client *http.Client) ([]string, error) {
+// Request a page with the provided client and parse the policies from the response. By default, a HEAD
+// request is sent first, and a GET request is sent if it fails, the server doesn't allow HEAD (405 or 501),
+// or the response has no CSP, since some servers only send security headers on GET.
+// In HTML mode, a GET request is always sent, and the <meta> policies in the page are added after the header ones.
+func GetCSP(ctx context.Context, rawURL string, client *http.Client, options CSPOptions) ([]Policy, error) {
 	url, err := URL.Parse(rawURL)
 	if err != nil {
 		return nil, err
 	}
 
-	res, err := http.Head(url.String())
+	err = options.Validate()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get CSP for %s: %v", url, err)
+		return nil, err
 	}
-	defer res.Body.Close()
 
-	out := parseCSP(res)
+	method := strings.ToLower(options.Method)
+	if options.HTML || method == MethodGet {
+		out, _, err := requestCSP(ctx, url.String(), http.MethodGet, client, options, options.HTML)
+		return out, err
+	}
+
+	out, status, err := requestCSP(ctx, url.String(), http.MethodHead, client, options, false)
+	if method == MethodHead {
+		return out, err
+	}
 
-	return out, nil
-}
\ No newline at end of file
+	headAllowed := err == nil && status != http.StatusMethodNotAllowed && status != http.StatusNotImplemented
+	if headAllowed && len(out) > 0 {
+		return out, nil
+	}
+
+	getOut, _, getErr := requestCSP(ctx, url.String(), http.MethodGet, client, options, false)
+	if getErr != nil && headAllowed {
+		// The HEAD request worked, there just wasn't a CSP
+		return out, nil
+	}
+
+	return getOut, getErr
+}
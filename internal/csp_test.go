@@ -1,12 +1,44 @@
 package internal
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
+// URL from a parsed policy, along with where the policy came from
+type policySource struct {
+	URL        string
+	Header     string
+	ReportOnly bool
+	Delivery   string
+}
+
+// Helper function to compare the URLs of parsed policies, without comparing every field
+func policySources(policies []Policy) []policySource {
+	var sources []policySource
+	for _, policy := range policies {
+		for _, source := range policy.URLSources() {
+			url, _ := source.URL()
+			sources = append(sources, policySource{url, policy.Header, policy.ReportOnly, policy.Delivery})
+		}
+	}
+	return sources
+}
+
+// Helper function to compare only the URLs of parsed policies
+func policyURLs(policies []Policy) []string {
+	var urls []string
+	for _, source := range policySources(policies) {
+		urls = append(urls, source.URL)
+	}
+	return urls
+}
+
 func TestParseCSP(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src https://example.com http://scripts.example.org http://*.example.org https://example.org:5443 http://test.example.org:*/path;")
@@ -27,7 +59,7 @@ func TestParseCSP(t *testing.T) {
 		"http://test.example.org/path",
 	}
 
-	csp := parseCSP(resp)
+	csp := policyURLs(parseCSP(resp))
 	if !reflect.DeepEqual(csp, expectedCSP) {
 		t.Logf("Expected: %v\n", expectedCSP)
 		t.Logf("Got:      %v\n", csp)
@@ -52,15 +84,163 @@ func TestGetCSP(t *testing.T) {
 
 	client := http.DefaultClient
 
-	csp, err := GetCSP(server.URL, client)
+	policies, err := GetCSP(context.Background(), server.URL, client, CSPOptions{})
 	if err != nil {
 		t.Error(err)
 	}
 
+	csp := policyURLs(policies)
+
 	if !reflect.DeepEqual(csp, expectedCSP) {
 		t.Logf("Expected: %v\n", expectedCSP)
 		t.Logf("Got %v\n", csp)
 		t.Error("results did not match expected.")
 	}
 	
-}
\ No newline at end of file
+}
+
+func TestParseCSPMultipleHeaders(t *testing.T) {
+	res := &http.Response{Header: http.Header{}}
+	res.Header.Add("Content-Security-Policy", "script-src https://a.example.com")
+	res.Header.Add("Content-Security-Policy", "img-src https://b.example.com, font-src https://c.example.com")
+	res.Header.Add("Content-Security-Policy-Report-Only", "script-src https://d.example.com")
+
+	expected := []policySource{
+		{URL: "https://a.example.com", Header: CSPHeader, Delivery: DeliveryHeader},
+		{URL: "https://b.example.com", Header: CSPHeader, Delivery: DeliveryHeader},
+		{URL: "https://c.example.com", Header: CSPHeader, Delivery: DeliveryHeader},
+		{URL: "https://d.example.com", Header: CSPReportOnlyHeader, ReportOnly: true, Delivery: DeliveryHeader},
+	}
+
+	sources := policySources(parseCSP(res))
+	if !reflect.DeepEqual(sources, expected) {
+		t.Logf("Expected: %+v\n", expected)
+		t.Logf("Got:      %+v\n", sources)
+		t.Error("results did not match expected.")
+	}
+}
+
+func TestParseMetaCSP(t *testing.T) {
+	page := `<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<META HTTP-EQUIV="content-security-policy" CONTENT="script-src 'self' https://cdn.example.com">
+	<meta http-equiv="Content-Security-Policy-Report-Only" content="script-src https://ignored.example.com">
+	<meta content="img-src https://img.example.com" http-equiv="Content-Security-Policy" />
+</head>
+<body>
+	<meta http-equiv="Content-Security-Policy" content="script-src https://body.example.com">
+</body>
+</html>`
+
+	expected := []policySource{
+		{URL: "https://cdn.example.com", Header: CSPHeader, Delivery: DeliveryMeta},
+		{URL: "https://img.example.com", Header: CSPHeader, Delivery: DeliveryMeta},
+	}
+
+	sources := policySources(parseMetaCSP(strings.NewReader(page)))
+	if !reflect.DeepEqual(sources, expected) {
+		t.Logf("Expected: %+v\n", expected)
+		t.Logf("Got:      %+v\n", sources)
+		t.Error("results did not match expected.")
+	}
+}
+
+func TestGetCSPHTML(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "script-src https://header.example.com")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><head><meta http-equiv="Content-Security-Policy" content="script-src https://meta.example.com"></head></html>`))
+	}))
+	defer server.Close()
+
+	expected := []policySource{
+		{URL: "https://header.example.com", Header: CSPHeader, Delivery: DeliveryHeader},
+		{URL: "https://meta.example.com", Header: CSPHeader, Delivery: DeliveryMeta},
+	}
+
+	policies, err := GetCSP(context.Background(), server.URL, http.DefaultClient, CSPOptions{HTML: true})
+	if err != nil {
+		t.Error(err)
+	}
+
+	sources := policySources(policies)
+
+	if !reflect.DeepEqual(sources, expected) {
+		t.Logf("Expected: %+v\n", expected)
+		t.Logf("Got:      %+v\n", sources)
+		t.Error("results did not match expected.")
+	}
+}
+
+// RoundTripper that counts requests by method, to check that the provided client is used
+type countingTransport struct {
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.requests[req.Method]++
+	c.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGetCSPMethodFallback(t *testing.T) {
+	// Rejects HEAD requests entirely
+	noHead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Security-Policy", "script-src https://a.example.com")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer noHead.Close()
+
+	// Only sends security headers on GET requests
+	getOnly := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Security-Policy", "script-src https://b.example.com")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer getOnly.Close()
+
+	tests := []struct {
+		description string
+		url         string
+		method      string
+		expected    []string
+		requests    map[string]int
+	}{
+		{"405 falls back to GET", noHead.URL, MethodAuto, []string{"https://a.example.com"}, map[string]int{"HEAD": 1, "GET": 1}},
+		{"missing CSP falls back to GET", getOnly.URL, "", []string{"https://b.example.com"}, map[string]int{"HEAD": 1, "GET": 1}},
+		{"forced HEAD", getOnly.URL, MethodHead, nil, map[string]int{"HEAD": 1}},
+		{"forced GET", getOnly.URL, MethodGet, []string{"https://b.example.com"}, map[string]int{"GET": 1}},
+	}
+
+	for _, test := range tests {
+		transport := &countingTransport{requests: map[string]int{}}
+		client := &http.Client{Transport: transport}
+
+		policies, err := GetCSP(context.Background(), test.url, client, CSPOptions{Method: test.method})
+		if err != nil {
+			t.Errorf("%s: %v", test.description, err)
+		}
+
+		urls := policyURLs(policies)
+		if !reflect.DeepEqual(urls, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.description, test.expected, urls)
+		}
+
+		if !reflect.DeepEqual(transport.requests, test.requests) {
+			t.Errorf("%s: expected requests %v through the provided client, got %v", test.description, test.requests, transport.requests)
+		}
+	}
+
+	if _, err := GetCSP(context.Background(), noHead.URL, http.DefaultClient, CSPOptions{Method: "post"}); err == nil {
+		t.Error("expected error for unknown method")
+	}
+}
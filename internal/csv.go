@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var csvHeader = []string{
+	"primary_url",
+	"secondary_url",
+	"directive",
+	"cname_target",
+	"service",
+	"verdict",
+	"severity",
+	"http_status",
+	"error",
+	"chain",
+}
+
+// Writes one CSV row for every primary and secondary URL pair as soon as each result is written.
+// Primary URLs that couldn't be scanned get a row without a secondary URL.
+type csvWriter struct {
+	out           *csv.Writer
+	headerWritten bool
+}
+
+func newCSVWriter(out io.Writer) *csvWriter {
+	return &csvWriter{out: csv.NewWriter(out)}
+}
+
+func (w *csvWriter) writeHeader() error {
+	if w.headerWritten {
+		return nil
+	}
+
+	w.headerWritten = true
+	return w.out.Write(csvHeader)
+}
+
+func (w *csvWriter) Write(result Result) error {
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	var severity, status, errorMessage string
+	if result.Vulnerable {
+		severity = result.Severity.String()
+	}
+	if result.HTTPStatus != 0 {
+		status = strconv.Itoa(result.HTTPStatus)
+	}
+	if result.Error != nil {
+		errorMessage = result.Error.Error()
+	}
+
+	err = w.out.Write([]string{
+		result.PrimaryURL,
+		result.SecondaryURL,
+		result.Directive,
+		result.CNAMETarget(),
+		result.Service,
+		result.Verdict(),
+		severity,
+		status,
+		errorMessage,
+		strings.Join(result.Chain, " -> "),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Flush each row, so the file can be followed while the scan runs
+	w.out.Flush()
+	return w.out.Error()
+}
+
+func (w *csvWriter) Close() error {
+	// Still write the header when there were no results
+	err := w.writeHeader()
+	if err != nil {
+		return err
+	}
+
+	w.out.Flush()
+	return w.out.Error()
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestCSVWriter(t *testing.T) {
+	results := []Result{
+		{PrimaryURL: "https://acme.com", SecondaryURL: "https://assets.acme.com/app.js", Directive: "script-src",
+			CNAMEChain: []string{"assets.acme.com", "acme.github.io"}, Vulnerable: true, Service: "Github",
+			Severity: SeverityMedium, HTTPStatus: 404,
+			Chain: []string{"https://acme.com", "https://widgets.acme.com/", "https://assets.acme.com/app.js"}},
+		{PrimaryURL: "https://acme.com", SecondaryURL: "https://cdn.acme.com/app.css", Directive: "style-src",
+			CNAMEChain: []string{"cdn.acme.com"}},
+		{PrimaryURL: "https://down.acme.com", Error: fmt.Errorf("connection refused")},
+	}
+
+	var out bytes.Buffer
+	writer, err := NewWriter(FormatCSV, &out, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if err := writer.Write(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		csvHeader,
+		{"https://acme.com", "https://assets.acme.com/app.js", "script-src", "acme.github.io", "Github", "vulnerable", "medium", "404", "",
+			"https://acme.com -> https://widgets.acme.com/ -> https://assets.acme.com/app.js"},
+		{"https://acme.com", "https://cdn.acme.com/app.css", "style-src", "", "", "not-vulnerable", "", "", "", ""},
+		{"https://down.acme.com", "", "", "", "", "error", "", "", "connection refused", ""},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("expected %v, got %v", expected, rows)
+	}
+}
+
+func TestCSVWriterEmpty(t *testing.T) {
+	var out bytes.Buffer
+	writer := newCSVWriter(&out)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 {
+		t.Errorf("expected only the header, got %v", rows)
+	}
+}
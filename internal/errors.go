@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	URL "net/url"
+)
+
+type ErrorKind string
+
+// Kinds of errors a URL can fail to be scanned with
+const (
+	// A DNS lookup failed, other than the host not existing
+	ErrorDNS ErrorKind = "dns"
+	// The TLS handshake failed, like an expired or untrusted certificate
+	ErrorTLS ErrorKind = "tls"
+	// A request or lookup timed out
+	ErrorTimeout ErrorKind = "timeout"
+	// The request failed, like a refused or reset connection
+	ErrorHTTP ErrorKind = "http"
+	// A URL or response couldn't be parsed
+	ErrorParse ErrorKind = "parse"
+	// Anything else
+	ErrorOther ErrorKind = "other"
+)
+
+// Error scanning a single primary or secondary URL. The scan carries on after these,
+// and they are counted by kind in the Summary.
+type ScanError struct {
+	Kind ErrorKind
+	// The error was temporary, like a connection reset or timeout, and was still failing after every retry
+	Retryable bool
+	Err       error
+}
+
+func (e *ScanError) Error() string {
+	return fmt.Sprintf("%s error: %v", e.Kind, e.Err)
+}
+
+func (e *ScanError) Unwrap() error {
+	return e.Err
+}
+
+// Wrap an error in a ScanError, classifying it by the errors it wraps. Errors that are
+// already a ScanError are returned as is.
+func newScanError(err error) *ScanError {
+	var scanErr *ScanError
+	if errors.As(err, &scanErr) {
+		return scanErr
+	}
+
+	return &ScanError{Kind: classifyError(err), Retryable: isRetryableError(err), Err: err}
+}
+
+// Get the kind of an error. Timeouts are checked first, since DNS and TLS errors can also be timeouts.
+func classifyError(err error) ErrorKind {
+	var scanErr *ScanError
+	if errors.As(err, &scanErr) {
+		return scanErr.Kind
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorTimeout
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ErrorDNS
+	}
+
+	var (
+		certErr      *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &certErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return ErrorTLS
+	}
+
+	var urlErr *URL.Error
+	if errors.As(err, &urlErr) {
+		if urlErr.Op == "parse" {
+			return ErrorParse
+		}
+		return ErrorHTTP
+	}
+
+	var parseErr *URL.EscapeError
+	if errors.As(err, &parseErr) {
+		return ErrorParse
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return ErrorHTTP
+	}
+
+	return ErrorOther
+}
@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	URL "net/url"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		description string
+		err         error
+		expected    ErrorKind
+	}{
+		{"dns", fmt.Errorf("failed: %w", &net.DNSError{Err: "server misbehaving", Name: "example.com"}), ErrorDNS},
+		{"dns timeout", &net.DNSError{Err: "timeout", Name: "example.com", IsTimeout: true}, ErrorTimeout},
+		{"deadline", fmt.Errorf("failed: %w", context.DeadlineExceeded), ErrorTimeout},
+		{"tls", &URL.Error{Op: "Get", URL: "https://example.com", Err: x509.UnknownAuthorityError{}}, ErrorTLS},
+		{"http", &URL.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}}, ErrorHTTP},
+		{"parse", &URL.Error{Op: "parse", URL: "%", Err: URL.EscapeError("%")}, ErrorParse},
+		{"already classified", fmt.Errorf("failed: %w", &ScanError{Kind: ErrorDNS, Err: fmt.Errorf("CNAME loop")}), ErrorDNS},
+		{"other", fmt.Errorf("something else"), ErrorOther},
+	}
+
+	for _, test := range tests {
+		got := classifyError(test.err)
+		if got != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.description, test.expected, got)
+		}
+	}
+}
+
+func TestGetCSPTimeoutError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 10 * time.Millisecond}
+	_, err := GetCSP(context.Background(), server.URL, client, CSPOptions{Method: MethodGet})
+	if err == nil {
+		t.Fatal("expected timeout error")
+	}
+
+	scanErr := newScanError(err)
+	if scanErr.Kind != ErrorTimeout {
+		t.Errorf("expected timeout error, got %s: %v", scanErr.Kind, err)
+	}
+}
+
+func TestProcessSecondaryURLsForwardsErrors(t *testing.T) {
+	urlsChannel := make(chan Result, 1)
+	resultsChannel := make(chan Result)
+
+	urlsChannel <- Result{PrimaryURL: "https://example.com", Error: &ScanError{Kind: ErrorHTTP, Err: fmt.Errorf("connection refused")}}
+	close(urlsChannel)
+
+	go ProcessSecondaryURLs(context.Background(), urlsChannel, resultsChannel, 0, http.DefaultClient, fakeResolver{}, nil)
+
+	var summary Summary
+	for result := range resultsChannel {
+		summary.Add(result)
+	}
+
+	if summary.Scanned != 1 || summary.ErrorCount() != 1 || summary.Errors[ErrorHTTP] != 1 {
+		t.Errorf("expected 1 http error, got %+v", summary)
+	}
+}
@@ -0,0 +1,332 @@
+package internal
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const fingerprintsURL = "https://raw.githubusercontent.com/EdOverflow/can-i-take-over-xyz/refs/heads/master/fingerprints.json"
+
+// How long cached fingerprints are used before scans revalidate them against upstream
+const fingerprintCacheMaxAge = 24 * time.Hour
+
+// Snapshot of the can-i-take-over-xyz fingerprints compiled into the binary, so scans still work
+// when GitHub is unreachable and nothing has been cached yet. Until embeddedFingerprintsCommit is
+// set, it is a hand-picked subset of upstream's services. scripts/update-fingerprint-snapshot.sh
+// replaces it with upstream's fingerprints.json as is and records the commit it was taken from.
+//
+//go:generate sh ../scripts/update-fingerprint-snapshot.sh
+//go:embed fingerprints.json
+var embeddedFingerprints []byte
+
+// Validators from the last download, sent back to GitHub so unchanged fingerprints aren't downloaded again.
+type fingerprintCacheMeta struct {
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+}
+
+// Parse fingerprints in the can-i-take-over-xyz JSON format, removing the non-vulnerable fingerprints.
+func parseFingerprints(data []byte) ([]Fingerprint, error) {
+	var all []Fingerprint
+	err := json.Unmarshal(data, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := vulnerableFingerprints(all)
+	if err := compileFingerprints(fingerprints); err != nil {
+		return nil, err
+	}
+
+	return fingerprints, nil
+}
+
+func vulnerableFingerprints(all []Fingerprint) []Fingerprint {
+	var fingerprints []Fingerprint
+	for _, fingerprint := range all {
+		if fingerprint.Vulnerable {
+			fingerprints = append(fingerprints, fingerprint)
+		}
+	}
+
+	return fingerprints
+}
+
+// Read every fingerprint from a file, including the non-vulnerable ones. Files ending in
+// .yaml or .yml are parsed as YAML, anything else as JSON.
+func readFingerprintsFile(path string) ([]Fingerprint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fingerprints file: %v", err)
+	}
+
+	var fingerprints []Fingerprint
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &fingerprints)
+	default:
+		err = json.Unmarshal(data, &fingerprints)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse fingerprints file %s: %v", path, err)
+	}
+
+	return fingerprints, nil
+}
+
+// Load fingerprints from a file in the can-i-take-over-xyz JSON format (or the same schema in YAML).
+func LoadFingerprints(path string) ([]Fingerprint, error) {
+	all, err := readFingerprintsFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := vulnerableFingerprints(all)
+	if err := compileFingerprints(fingerprints); err != nil {
+		return nil, fmt.Errorf("failed to parse fingerprints file %s: %v", path, err)
+	}
+
+	return fingerprints, nil
+}
+
+// Load custom fingerprints to merge into the upstream list with MergeFingerprints. Unlike
+// LoadFingerprints, fingerprints with "vulnerable": false are kept, since they disable the
+// upstream fingerprint for that service.
+func LoadCustomFingerprints(path string) ([]Fingerprint, error) {
+	fingerprints, err := readFingerprintsFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fingerprint := range fingerprints {
+		if fingerprint.Service == "" {
+			return nil, fmt.Errorf("failed to parse fingerprints file %s: fingerprint for %v is missing a service name", path, fingerprint.Cname)
+		}
+	}
+
+	if err := compileFingerprints(fingerprints); err != nil {
+		return nil, fmt.Errorf("failed to parse fingerprints file %s: %v", path, err)
+	}
+
+	return fingerprints, nil
+}
+
+// Merge custom fingerprints with the upstream list. Service names are compared case-insensitively.
+//
+// Parameters:
+// 	- base: Upstream fingerprints, usually from GetCachedFingerprints() or EmbeddedFingerprints().
+// 	- custom: Custom fingerprints, which replace any base fingerprint for the same service. Custom fingerprints
+//		with "vulnerable": false remove the service instead. Custom fingerprints are checked before base ones,
+//		so they win when both match the same host.
+// 	- disabled: Service names to remove from the merged list.
+func MergeFingerprints(base []Fingerprint, custom []Fingerprint, disabled []string) []Fingerprint {
+	removed := make(map[string]bool)
+	for _, service := range disabled {
+		removed[strings.ToLower(strings.TrimSpace(service))] = true
+	}
+
+	var merged []Fingerprint
+	overridden := make(map[string]bool)
+	for _, fingerprint := range custom {
+		service := strings.ToLower(fingerprint.Service)
+		overridden[service] = true
+		if fingerprint.Vulnerable && !removed[service] {
+			merged = append(merged, fingerprint)
+		}
+	}
+
+	for _, fingerprint := range base {
+		service := strings.ToLower(fingerprint.Service)
+		if overridden[service] || removed[service] {
+			continue
+		}
+		merged = append(merged, fingerprint)
+	}
+
+	return merged
+}
+
+// Get every service a scan with the fingerprints can report, in the order fingerprints are
+// checked, followed by the bucket providers.
+func ScanServices(fingerprints []Fingerprint) []string {
+	seen := map[string]bool{}
+	var services []string
+	add := func(service string) {
+		if service != "" && !seen[service] {
+			seen[service] = true
+			services = append(services, service)
+		}
+	}
+
+	for _, fingerprint := range fingerprints {
+		add(fingerprint.Service)
+	}
+	for _, provider := range bucketProviders {
+		add(provider.name)
+	}
+	return services
+}
+
+// Get the fingerprints compiled into the binary.
+func EmbeddedFingerprints() ([]Fingerprint, error) {
+	fingerprints, err := parseFingerprints(embeddedFingerprints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse built-in fingerprints: %v", err)
+	}
+
+	return fingerprints, nil
+}
+
+// Describe where the built-in fingerprints came from, for messages about falling back to them.
+func EmbeddedFingerprintsSource() string {
+	if embeddedFingerprintsCommit == "" {
+		return "an unversioned partial snapshot of can-i-take-over-xyz, which may miss services"
+	}
+	return "can-i-take-over-xyz commit " + embeddedFingerprintsCommit
+}
+
+// Get the directory fingerprints are cached in, which is $XDG_CACHE_HOME/cspscan on Linux
+// (defaulting to ~/.cache/cspscan) and the platform's user cache directory elsewhere.
+func FingerprintCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find cache directory: %v", err)
+	}
+
+	return filepath.Join(dir, "cspscan"), nil
+}
+
+func readCacheMeta(cacheDir string) fingerprintCacheMeta {
+	var meta fingerprintCacheMeta
+	data, err := os.ReadFile(filepath.Join(cacheDir, "fingerprints.meta.json"))
+	if err != nil {
+		return meta
+	}
+
+	// A corrupt meta file only means the next update is a full download
+	_ = json.Unmarshal(data, &meta)
+	return meta
+}
+
+// Download the fingerprints into the cache directory, revalidating with the ETag and Last-Modified
+// headers from the previous download so the file is only downloaded again if it changed upstream.
+//
+// Parameters:
+// 	- cacheDir: Directory to store the fingerprints in, usually from FingerprintCacheDir().
+// 	- testingReplacementURL: OPTIONAL url string which will replace the URL for the fingerprints if provided, for use in testing.
+//
+// Returns true if new fingerprints were downloaded, or false if the cache was already up to date.
+func UpdateFingerprintCache(cacheDir string, testingReplacementURL string, client *http.Client) (bool, error) {
+	url := fingerprintsURL
+	if testingReplacementURL != "" {
+		url = testingReplacementURL
+	}
+
+	cachePath := filepath.Join(cacheDir, "fingerprints.json")
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to update subdomain takeover fingerprints: %v", err)
+	}
+
+	// Only revalidate if there is a cached file to fall back on
+	if _, err := os.Stat(cachePath); err == nil {
+		meta := readCacheMeta(cacheDir)
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to update subdomain takeover fingerprints: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		// Mark the cache as fresh again. A cache that can't be touched is only revalidated sooner.
+		now := time.Now()
+		_ = os.Chtimes(cachePath, now, now)
+		return false, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("failed to update subdomain takeover fingerprints: unexpected status %s", res.Status)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return false, fmt.Errorf("failed to update subdomain takeover fingerprints: %v", err)
+	}
+
+	// Make sure the download is usable before replacing a working cache with it
+	if _, err := parseFingerprints(data); err != nil {
+		return false, fmt.Errorf("failed to update subdomain takeover fingerprints: %v", err)
+	}
+
+	err = os.MkdirAll(cacheDir, 0o755)
+	if err != nil {
+		return false, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	// Write to a temporary file first so an interrupted update can't leave a truncated cache
+	tmpPath := cachePath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("failed to write fingerprint cache: %v", err)
+	}
+
+	err = os.Rename(tmpPath, cachePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to write fingerprint cache: %v", err)
+	}
+
+	meta, err := json.Marshal(fingerprintCacheMeta{
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	})
+	if err != nil {
+		return true, fmt.Errorf("failed to write fingerprint cache metadata: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(cacheDir, "fingerprints.meta.json"), meta, 0o644)
+	if err != nil {
+		return true, fmt.Errorf("failed to write fingerprint cache metadata: %v", err)
+	}
+
+	return true, nil
+}
+
+// Get the cached fingerprints, revalidating them against upstream first if they were last checked
+// more than a day ago. If upstream can't be reached, the cached fingerprints are still used.
+// An error is only returned if there is no usable cache.
+func GetCachedFingerprints(cacheDir string, testingReplacementURL string, client *http.Client) ([]Fingerprint, error) {
+	cachePath := filepath.Join(cacheDir, "fingerprints.json")
+
+	var updateErr error
+	if info, err := os.Stat(cachePath); err != nil || time.Since(info.ModTime()) > fingerprintCacheMaxAge {
+		_, updateErr = UpdateFingerprintCache(cacheDir, testingReplacementURL, client)
+	}
+
+	fingerprints, err := LoadFingerprints(cachePath)
+	if err != nil {
+		if updateErr != nil {
+			return nil, updateErr
+		}
+		return nil, err
+	}
+
+	return fingerprints, nil
+}
@@ -0,0 +1,5 @@
+package internal
+
+// can-i-take-over-xyz commit the built-in fingerprints.json was taken from, or empty while it is
+// the hand-picked subset. scripts/update-fingerprint-snapshot.sh regenerates this file.
+const embeddedFingerprintsCommit = ""
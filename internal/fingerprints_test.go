@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testFingerprintsJSON = `[
+	{"cname": ["a.com"], "fingerprint": "NXDOMAIN", "nxdomain": true, "service": "A", "vulnerable": false},
+	{"cname": ["b.com"], "fingerprint": "NXDOMAIN", "nxdomain": true, "service": "B", "vulnerable": false},
+	{"cname": ["c.com"], "fingerprint": "not found", "nxdomain": false, "service": "C", "vulnerable": true}
+]`
+
+func TestParseFingerprints(t *testing.T) {
+	// Consecutive non-vulnerable fingerprints should all be removed
+	fingerprints, err := parseFingerprints([]byte(testFingerprintsJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fingerprints) != 1 || fingerprints[0].Service != "C" {
+		t.Errorf("expected only fingerprint C, got %+v", fingerprints)
+	}
+
+	if _, err := parseFingerprints([]byte("not json")); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestEmbeddedFingerprints(t *testing.T) {
+	fingerprints, err := EmbeddedFingerprints()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fingerprints) == 0 {
+		t.Error("expected built-in fingerprints")
+	}
+
+	for _, fingerprint := range fingerprints {
+		if !fingerprint.Vulnerable {
+			t.Errorf("expected non-vulnerable fingerprint %s to be removed", fingerprint.Service)
+		}
+	}
+}
+
+func TestLoadFingerprints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fingerprints.json")
+	err := os.WriteFile(path, []byte(testFingerprintsJSON), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprints, err := LoadFingerprints(path)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(fingerprints) != 1 {
+		t.Errorf("expected 1 fingerprint, got %d", len(fingerprints))
+	}
+
+	if _, err := LoadFingerprints(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("expected error for missing file")
+	}
+
+	// Patterns are compiled once when loading, so bad ones are found before any check
+	if len(fingerprints) == 1 && (len(fingerprints[0].compiled) != 1 || fingerprints[0].compiled[0].regexes == nil) {
+		t.Errorf("expected compiled matchers, got %+v", fingerprints[0].compiled)
+	}
+
+	for _, invalid := range []string{
+		`[{"cname": ["c.com"], "fingerprint": "(", "service": "C", "vulnerable": true}]`,
+		`[{"cname": ["c.com"], "service": "C", "vulnerable": true, "matchers": [{"type": "body", "patterns": ["x"], "condition": "xor"}]}]`,
+	} {
+		if err := os.WriteFile(path, []byte(invalid), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadFingerprints(path); err == nil {
+			t.Errorf("expected error for %s", invalid)
+		}
+	}
+}
+
+func TestUpdateFingerprintCache(t *testing.T) {
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		downloads++
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(testFingerprintsJSON))
+	}))
+
+	cacheDir := filepath.Join(t.TempDir(), "cspscan")
+
+	updated, err := UpdateFingerprintCache(cacheDir, server.URL, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated {
+		t.Error("expected first update to download fingerprints")
+	}
+
+	// The second update should be revalidated with the ETag rather than downloaded again
+	updated, err = UpdateFingerprintCache(cacheDir, server.URL, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated || downloads != 1 {
+		t.Errorf("expected cache to be up to date, got updated=%v downloads=%d", updated, downloads)
+	}
+
+	// A fresh cache isn't revalidated at all
+	requests := 0
+	counted := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	defer counted.Close()
+	if _, err := GetCachedFingerprints(cacheDir, counted.URL, http.DefaultClient); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 {
+		t.Errorf("expected a fresh cache to not be revalidated, got %d requests", requests)
+	}
+
+	// A stale one is, and is fresh again once upstream says it hasn't changed
+	stale := time.Now().Add(-2 * fingerprintCacheMaxAge)
+	if err := os.Chtimes(filepath.Join(cacheDir, "fingerprints.json"), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetCachedFingerprints(cacheDir, counted.URL, http.DefaultClient); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetCachedFingerprints(cacheDir, counted.URL, http.DefaultClient); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("expected a stale cache to be revalidated once, got %d requests", requests)
+	}
+
+	// The cache should still be used once upstream is unreachable
+	if err := os.Chtimes(filepath.Join(cacheDir, "fingerprints.json"), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	fingerprints, err := GetCachedFingerprints(cacheDir, server.URL, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fingerprints) != 1 || fingerprints[0].Service != "C" {
+		t.Errorf("expected cached fingerprint C, got %+v", fingerprints)
+	}
+
+	if _, err := GetCachedFingerprints(t.TempDir(), server.URL, http.DefaultClient); err == nil {
+		t.Error("expected error without cache or upstream")
+	}
+}
+
+func TestUpdateFingerprintCacheInvalid(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<html>rate limited</html>"))
+	}))
+	defer server.Close()
+
+	cacheDir := t.TempDir()
+	if _, err := UpdateFingerprintCache(cacheDir, server.URL, http.DefaultClient); err == nil {
+		t.Error("expected error for invalid fingerprints")
+	}
+
+	if _, err := os.Stat(filepath.Join(cacheDir, "fingerprints.json")); err == nil {
+		t.Error("expected invalid fingerprints to not be cached")
+	}
+}
+
+func TestLoadCustomFingerprints(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlPath := filepath.Join(dir, "custom.yaml")
+	err := os.WriteFile(yamlPath, []byte(`
+- service: Acme CDN
+  cname: [cdn.acme.internal]
+  fingerprint: "No such distribution"
+  vulnerable: true
+- service: Github
+  vulnerable: false
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprints, err := LoadCustomFingerprints(yamlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Fingerprint{
+		Cname:       []string{"cdn.acme.internal"},
+		Fingerprint: "No such distribution",
+		Service:     "Acme CDN",
+		Vulnerable:  true,
+	}
+	if len(fingerprints) != 2 || !fingerprints[0].IsSameAs(expected) || fingerprints[1].Vulnerable {
+		t.Errorf("unexpected custom fingerprints: %+v", fingerprints)
+	}
+
+	jsonPath := filepath.Join(dir, "custom.json")
+	err = os.WriteFile(jsonPath, []byte(`[{"cname": ["static.acme.internal"], "fingerprint": "NXDOMAIN", "nxdomain": true, "vulnerable": true}]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadCustomFingerprints(jsonPath); err == nil {
+		t.Error("expected error for fingerprint without a service name")
+	}
+
+	err = os.WriteFile(jsonPath, []byte(`[{"service": "Acme", "matchers_condition": "any", "matchers": [{"type": "status", "status": [404]}]}]`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadCustomFingerprints(jsonPath); err == nil {
+		t.Error("expected error for an unknown matchers_condition")
+	}
+}
+
+func TestMergeFingerprints(t *testing.T) {
+	base := []Fingerprint{
+		{Service: "Github", Cname: []string{"github.io"}, Vulnerable: true},
+		{Service: "Heroku", Cname: []string{"herokuapp.com"}, Vulnerable: true},
+		{Service: "Surge.sh", Cname: []string{"surge.sh"}, Vulnerable: true},
+	}
+
+	custom := []Fingerprint{
+		{Service: "Acme CDN", Cname: []string{"cdn.acme.internal"}, Vulnerable: true},
+		{Service: "heroku", Cname: []string{"herokuapp.com"}, Fingerprint: "No such app", Vulnerable: true},
+		{Service: "Github", Vulnerable: false},
+	}
+
+	merged := MergeFingerprints(base, custom, []string{"Surge.sh"})
+
+	var services []string
+	for _, fingerprint := range merged {
+		services = append(services, fingerprint.Service)
+	}
+
+	// Custom fingerprints come first, the overridden and disabled upstream ones are removed
+	expected := []string{"Acme CDN", "heroku"}
+	if len(services) != len(expected) || services[0] != expected[0] || services[1] != expected[1] {
+		t.Errorf("expected %v, got %v", expected, services)
+	}
+
+	if merged[1].Fingerprint != "No such app" {
+		t.Errorf("expected custom Heroku fingerprint, got %+v", merged[1])
+	}
+}
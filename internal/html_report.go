@@ -0,0 +1,172 @@
+package internal
+
+import (
+	_ "embed"
+	"html/template"
+	"io"
+	"sort"
+)
+
+//go:embed report.html
+var reportTemplateHTML string
+
+var reportTemplate = template.Must(template.New("report").Parse(reportTemplateHTML))
+
+type htmlSource struct {
+	Raw string
+	// The source is one of the primary URL's findings
+	Dangling bool
+}
+
+type htmlDirective struct {
+	Name    string
+	Sources []htmlSource
+}
+
+type htmlPolicy struct {
+	// Page that sent the policy, which is a followed page rather than the primary URL for sources found on followed pages
+	URL        string
+	Header     string
+	Delivery   string
+	Directives []htmlDirective
+}
+
+type htmlFinding struct {
+	SecondaryURL string
+	Directive    string
+	ReportOnly   bool
+	Service      string
+	Severity     string
+	Evidence     []string
+	// Followed pages between the primary and secondary URL
+	Via []string
+}
+
+type htmlPrimary struct {
+	URL      string
+	Findings []htmlFinding
+	Policies []htmlPolicy
+}
+
+type htmlServiceCount struct {
+	Service string
+	Count   int
+}
+
+type htmlReport struct {
+	Scanned    int
+	Vulnerable int
+	Errors     int
+	Services   []htmlServiceCount
+	Primaries  []htmlPrimary
+}
+
+// Writes a single static HTML report once closed. Findings are grouped by primary URL, along
+// with the policies they were found in, with the dangling sources highlighted.
+type htmlWriter struct {
+	out     io.Writer
+	summary Summary
+	// Primary URLs in the order their first finding came in
+	primaries []string
+	// Vulnerable results for each primary URL
+	findings map[string][]Result
+}
+
+func newHTMLWriter(out io.Writer) *htmlWriter {
+	return &htmlWriter{out: out, findings: map[string][]Result{}}
+}
+
+func (w *htmlWriter) Write(result Result) error {
+	w.summary.Add(result)
+	if !result.Vulnerable || result.Error != nil {
+		return nil
+	}
+
+	if _, ok := w.findings[result.PrimaryURL]; !ok {
+		w.primaries = append(w.primaries, result.PrimaryURL)
+	}
+	w.findings[result.PrimaryURL] = append(w.findings[result.PrimaryURL], result)
+	return nil
+}
+
+// Build the policy for the report, marking the sources that point at a dangling URL.
+func newHTMLPolicy(url string, policy *Policy, dangling map[string]bool) htmlPolicy {
+	out := htmlPolicy{URL: url, Header: policy.Header, Delivery: policy.Delivery}
+	for _, directive := range policy.Directives {
+		htmlDirective := htmlDirective{Name: directive.Name}
+		for _, source := range directive.Sources {
+			url, ok := source.URL()
+			htmlDirective.Sources = append(htmlDirective.Sources, htmlSource{
+				Raw:      source.Raw,
+				Dangling: ok && dangling[directive.Name+" "+url],
+			})
+		}
+		out.Directives = append(out.Directives, htmlDirective)
+	}
+
+	return out
+}
+
+// Get the page a result's policy was sent by, the last URL in the chain before the secondary URL.
+func policyPage(result Result) string {
+	if len(result.Chain) < 2 {
+		return result.PrimaryURL
+	}
+	return result.Chain[len(result.Chain)-2]
+}
+
+func (w *htmlWriter) report() htmlReport {
+	report := htmlReport{
+		Scanned:    w.summary.Scanned,
+		Vulnerable: w.summary.Vulnerable,
+		Errors:     w.summary.ErrorCount(),
+	}
+
+	services := map[string]int{}
+	for _, primaryURL := range w.primaries {
+		primary := htmlPrimary{URL: primaryURL}
+		dangling := map[string]bool{}
+		var policies []*Policy
+		pages := map[*Policy]string{}
+
+		for _, result := range w.findings[primaryURL] {
+			services[result.Service]++
+			dangling[result.Directive+" "+result.SecondaryURL] = true
+			primary.Findings = append(primary.Findings, htmlFinding{
+				SecondaryURL: result.SecondaryURL,
+				Directive:    result.Directive,
+				ReportOnly:   result.ReportOnly,
+				Service:      result.Service,
+				Severity:     result.Severity.String(),
+				Evidence:     result.Evidence,
+				Via:          result.Via(),
+			})
+
+			if _, seen := pages[result.Policy]; result.Policy != nil && !seen {
+				pages[result.Policy] = policyPage(result)
+				policies = append(policies, result.Policy)
+			}
+		}
+
+		for _, policy := range policies {
+			primary.Policies = append(primary.Policies, newHTMLPolicy(pages[policy], policy, dangling))
+		}
+		report.Primaries = append(report.Primaries, primary)
+	}
+
+	for service, count := range services {
+		report.Services = append(report.Services, htmlServiceCount{Service: service, Count: count})
+	}
+	sort.Slice(report.Services, func(i, j int) bool {
+		if report.Services[i].Count != report.Services[j].Count {
+			return report.Services[i].Count > report.Services[j].Count
+		}
+		return report.Services[i].Service < report.Services[j].Service
+	})
+
+	return report
+}
+
+func (w *htmlWriter) Close() error {
+	return reportTemplate.Execute(w.out, w.report())
+}
@@ -0,0 +1,72 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHTMLWriter(t *testing.T) {
+	policy := ParsePolicy("default-src 'self'; script-src https://dangling.cloudapp.net https://cdn.acme.com; img-src https://acme.github.io")
+	policy.Header = CSPHeader
+	policy.Delivery = DeliveryHeader
+
+	followed := ParsePolicy("script-src https://stale.cloudapp.net")
+	followed.Header = CSPHeader
+	followed.Delivery = DeliveryHeader
+
+	results := []Result{
+		{PrimaryURL: "https://acme.com", SecondaryURL: "https://dangling.cloudapp.net", Directive: "script-src",
+			Policy: &policy, Vulnerable: true, Service: "Microsoft Azure", Severity: SeverityHigh,
+			Evidence: []string{"dangling.cloudapp.net returned NXDOMAIN"}},
+		{PrimaryURL: "https://acme.com", SecondaryURL: "https://cdn.acme.com", Directive: "script-src", Policy: &policy},
+		{PrimaryURL: "https://acme.com", SecondaryURL: "https://acme.github.io", Directive: "img-src",
+			Policy: &policy, Vulnerable: true, Service: "Github", Severity: SeverityInfo},
+		{PrimaryURL: "https://acme.com", SecondaryURL: "https://stale.cloudapp.net", Directive: "script-src",
+			Policy: &followed, Chain: []string{"https://acme.com", "https://cdn.acme.com", "https://stale.cloudapp.net"},
+			Vulnerable: true, Service: "Microsoft Azure", Severity: SeverityHigh},
+		{PrimaryURL: "https://<script>.acme.com", SecondaryURL: "https://other.cloudapp.net", Directive: "script-src",
+			Vulnerable: true, Service: "Microsoft Azure", Severity: SeverityHigh},
+	}
+
+	var out bytes.Buffer
+	writer, err := NewWriter(FormatHTML, &out, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if err := writer.Write(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	report := out.String()
+	for _, expected := range []string{
+		`<td>Microsoft Azure</td><td>3</td>`,
+		`<td>Github</td><td>1</td>`,
+		`<span class="dangling">https://dangling.cloudapp.net</span>`,
+		`<span class="dangling">https://acme.github.io</span>`,
+		`<li>dangling.cloudapp.net returned NXDOMAIN</li>`,
+		`&lt;script&gt;`,
+		// Policies are labelled with the page that sent them, which isn't the primary URL for followed pages
+		`Content-Security-Policy from https://acme.com</p>`,
+		`Content-Security-Policy from https://cdn.acme.com</p>`,
+	} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("expected report to contain %s", expected)
+		}
+	}
+
+	if strings.Contains(report, `<span class="dangling">https://cdn.acme.com</span>`) {
+		t.Error("expected sources that aren't vulnerable to not be highlighted")
+	}
+	if strings.Contains(report, "<script>") {
+		t.Error("expected URLs to be escaped")
+	}
+	if strings.Count(report, `<div class="policy">`) != 2 {
+		t.Error("expected the shared policy to be shown once, and the followed page's policy separately")
+	}
+}
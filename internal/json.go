@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// A result as it is written in the json and jsonl formats.
+type jsonResult struct {
+	PrimaryURL   string   `json:"primary_url"`
+	SecondaryURL string   `json:"secondary_url,omitempty"`
+	Chain        []string `json:"chain,omitempty"`
+	Directive    string   `json:"directive,omitempty"`
+	ReportOnly   bool     `json:"report_only,omitempty"`
+	Delivery     string   `json:"delivery,omitempty"`
+	CNAMEChain   []string `json:"cname_chain,omitempty"`
+	Service      string   `json:"service,omitempty"`
+	Evidence     []string `json:"evidence,omitempty"`
+	Verdict      string   `json:"verdict"`
+	Severity     string   `json:"severity,omitempty"`
+	HTTPStatus   int      `json:"http_status,omitempty"`
+	Attempts     int      `json:"attempts,omitempty"`
+	Bucket       *Bucket  `json:"bucket,omitempty"`
+	Error        string   `json:"error,omitempty"`
+	ErrorKind    string   `json:"error_kind,omitempty"`
+	Retryable    bool     `json:"retryable,omitempty"`
+}
+
+func newJSONResult(result Result) jsonResult {
+	out := jsonResult{
+		PrimaryURL:   result.PrimaryURL,
+		SecondaryURL: result.SecondaryURL,
+		Chain:        result.Chain,
+		Directive:    result.Directive,
+		ReportOnly:   result.ReportOnly,
+		Delivery:     result.Delivery,
+		CNAMEChain:   result.CNAMEChain,
+		Service:      result.Service,
+		Evidence:     result.Evidence,
+		Verdict:      result.Verdict(),
+		HTTPStatus:   result.HTTPStatus,
+		Attempts:     result.Attempts,
+		Bucket:       result.Bucket,
+	}
+
+	if result.Vulnerable {
+		out.Severity = result.Severity.String()
+	}
+
+	if result.Error != nil {
+		out.Error = result.Error.Error()
+		out.ErrorKind = string(classifyError(result.Error))
+		var scanErr *ScanError
+		out.Retryable = errors.As(result.Error, &scanErr) && scanErr.Retryable
+	}
+
+	return out
+}
+
+// Writes results as soon as each result is written, either as elements of a JSON array that is
+// ended once closed, or with lines set, as one JSON object per line. Nothing is held in memory,
+// so long scans can be streamed.
+type jsonWriter struct {
+	out   io.Writer
+	lines bool
+	// At least one element of the array has been written
+	started bool
+}
+
+func (w *jsonWriter) Write(result Result) error {
+	if w.lines {
+		return json.NewEncoder(w.out).Encode(newJSONResult(result))
+	}
+
+	data, err := json.MarshalIndent(newJSONResult(result), "  ", "  ")
+	if err != nil {
+		return err
+	}
+
+	separator := ",\n  "
+	if !w.started {
+		separator = "[\n  "
+		w.started = true
+	}
+
+	_, err = io.WriteString(w.out, separator+string(data))
+	return err
+}
+
+func (w *jsonWriter) Close() error {
+	if w.lines {
+		return nil
+	}
+
+	// Write an empty array rather than null when there are no results
+	if !w.started {
+		_, err := io.WriteString(w.out, "[]\n")
+		return err
+	}
+
+	_, err := io.WriteString(w.out, "\n]\n")
+	return err
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var jsonTestResults = []Result{
+	{
+		PrimaryURL:   "https://acme.com",
+		SecondaryURL: "https://dangling.acme.com/app.js",
+		Directive:    "script-src",
+		Vulnerable:   true,
+		Service:      "Microsoft Azure",
+		Severity:     SeverityHigh,
+		Evidence:     []string{"dangling.acme.com returned NXDOMAIN"},
+	},
+	{PrimaryURL: "https://acme.com", SecondaryURL: "https://cdn.acme.com/app.css", Directive: "style-src"},
+	{PrimaryURL: "https://down.acme.com", Error: &ScanError{Kind: ErrorTimeout, Err: fmt.Errorf("deadline exceeded")}},
+}
+
+func TestJSONLWriter(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewWriter(FormatJSONL, &out, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range jsonTestResults {
+		if err := writer.Write(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(jsonTestResults) {
+		t.Fatalf("expected %d lines, got %d: %s", len(jsonTestResults), len(lines), out.String())
+	}
+
+	var first jsonResult
+	if err := json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if first.Verdict != VerdictVulnerable || first.Service != "Microsoft Azure" || first.Severity != "high" ||
+		first.Directive != "script-src" || len(first.Evidence) != 1 {
+		t.Errorf("unexpected vulnerable result: %+v", first)
+	}
+
+	var failed jsonResult
+	if err := json.Unmarshal([]byte(lines[2]), &failed); err != nil {
+		t.Fatal(err)
+	}
+	if failed.Verdict != VerdictError || failed.ErrorKind != string(ErrorTimeout) || failed.Error == "" {
+		t.Errorf("unexpected failed result: %+v", failed)
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	var out bytes.Buffer
+	writer, err := NewWriter(FormatJSON, &out, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, result := range jsonTestResults {
+		before := out.Len()
+		if err := writer.Write(result); err != nil {
+			t.Fatal(err)
+		}
+		if out.Len() == before {
+			t.Errorf("expected result %d to be written straight away", i)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var results []jsonResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(jsonTestResults) {
+		t.Fatalf("expected %d results, got %d", len(jsonTestResults), len(results))
+	}
+	if results[1].Verdict != VerdictNotVulnerable || results[1].Severity != "" {
+		t.Errorf("unexpected result: %+v", results[1])
+	}
+}
+
+func TestJSONWriterEmpty(t *testing.T) {
+	var out bytes.Buffer
+	writer := &jsonWriter{out: &out}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out.String()) != "[]" {
+		t.Errorf("expected empty array, got %s", out.String())
+	}
+}
+
+func TestNewWriterUnknownFormat(t *testing.T) {
+	if _, err := NewWriter("xml", &bytes.Buffer{}, WriterOptions{}); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Matcher types
+const (
+	MatchStatus = "status"
+	MatchHeader = "header"
+	MatchBody   = "body"
+)
+
+// Conditions for combining patterns in a matcher, or matchers in a fingerprint
+const (
+	ConditionAnd = "and"
+	ConditionOr  = "or"
+)
+
+// Get a condition in the form it is compared in, so "AND" and "and" mean the same thing.
+func normalizeCondition(condition string) string {
+	return strings.ToLower(strings.TrimSpace(condition))
+}
+
+// Check that a condition is empty (the default) or one of ConditionAnd or ConditionOr.
+func validateCondition(condition string) error {
+	switch normalizeCondition(condition) {
+	case "", ConditionAnd, ConditionOr:
+		return nil
+	default:
+		return fmt.Errorf("unknown condition %q, expected %q or %q", condition, ConditionAnd, ConditionOr)
+	}
+}
+
+// Matcher checks one part of the HTTP response from a possibly vulnerable URL. Matchers are an
+// extension to the can-i-take-over-xyz format for custom fingerprints, for services that can only
+// be told apart by status code or headers, or that need more than one body pattern.
+type Matcher struct {
+	// One of "status", "header" or "body"
+	Type string `json:"type" yaml:"type"`
+	// Status codes for status matchers, any of which match
+	Status []int `json:"status,omitempty" yaml:"status,omitempty"`
+	// Header name for header matchers, like "x-amz-error-code"
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Regexes for header and body matchers. A header matcher without patterns only checks that the header exists.
+	Patterns []string `json:"patterns,omitempty" yaml:"patterns,omitempty"`
+	// How patterns are combined, either "and" or "or" (default)
+	Condition string `json:"condition,omitempty" yaml:"condition,omitempty"`
+	// Invert the result, so the matcher only matches responses that don't match
+	Negative bool `json:"negative,omitempty" yaml:"negative,omitempty"`
+
+	// Compiled Patterns, set by compile so they aren't compiled again for every response
+	regexes []*regexp.Regexp
+}
+
+// Compile regexes, so the same patterns can be matched against many responses.
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var regexes []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile pattern %s: %v", pattern, err)
+		}
+		regexes = append(regexes, re)
+	}
+
+	return regexes, nil
+}
+
+// Check that a matcher is well formed, so mistakes in fingerprint files are found when loading them
+// rather than failing every check.
+func (m Matcher) validate() error {
+	_, err := m.compile()
+	return err
+}
+
+// Check that a matcher is well formed and get a copy of it with its patterns compiled.
+func (m Matcher) compile() (Matcher, error) {
+	switch m.Type {
+	case MatchStatus:
+		if len(m.Status) == 0 {
+			return m, fmt.Errorf("status matcher has no status codes")
+		}
+	case MatchHeader:
+		if m.Name == "" {
+			return m, fmt.Errorf("header matcher has no header name")
+		}
+	case MatchBody:
+		if len(m.Patterns) == 0 {
+			return m, fmt.Errorf("body matcher has no patterns")
+		}
+	default:
+		return m, fmt.Errorf("unknown matcher type %q", m.Type)
+	}
+
+	if err := validateCondition(m.Condition); err != nil {
+		return m, fmt.Errorf("invalid matcher condition: %v", err)
+	}
+
+	regexes, err := compilePatterns(m.Patterns)
+	if err != nil {
+		return m, err
+	}
+
+	m.regexes = regexes
+	return m, nil
+}
+
+// Check if the patterns match any of the values, combined with the matcher's condition.
+// Matchers that weren't compiled, like ones built in code, have their patterns compiled on every call.
+func (m Matcher) matchPatterns(values []string) (bool, error) {
+	regexes := m.regexes
+	if regexes == nil {
+		var err error
+		regexes, err = compilePatterns(m.Patterns)
+		if err != nil {
+			return false, fmt.Errorf("failed to compile vulnerability detection fingerprint: %v", err)
+		}
+	}
+
+	and := normalizeCondition(m.Condition) == ConditionAnd
+	for _, re := range regexes {
+		matched := false
+		for _, value := range values {
+			if re.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+
+		if and && !matched {
+			return false, nil
+		}
+		if !and && matched {
+			return true, nil
+		}
+	}
+
+	// Every pattern matched for "and", or none did for "or"
+	return and, nil
+}
+
+// Check if the matcher matches the response. The body is passed separately since it has already been read.
+func (m Matcher) match(res *http.Response, body []byte) (bool, error) {
+	var matched bool
+	var err error
+
+	switch m.Type {
+	case MatchStatus:
+		for _, status := range m.Status {
+			if res.StatusCode == status {
+				matched = true
+				break
+			}
+		}
+	case MatchHeader:
+		values := res.Header.Values(m.Name)
+		if len(m.Patterns) == 0 {
+			matched = len(values) > 0
+		} else {
+			matched, err = m.matchPatterns(values)
+		}
+	case MatchBody:
+		matched, err = m.matchPatterns([]string{string(body)})
+	default:
+		err = fmt.Errorf("unknown matcher type %q", m.Type)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return matched != m.Negative, nil
+}
+
+// Check that a fingerprint's matchers and matchers condition are well formed.
+func (f Fingerprint) validate() error {
+	_, err := f.compile()
+	return err
+}
+
+// Check that a fingerprint is well formed and get a copy of it with its matchers compiled,
+// including the ones for the can-i-take-over-xyz fields.
+func (f Fingerprint) compile() (Fingerprint, error) {
+	if err := validateCondition(f.MatchersCondition); err != nil {
+		return f, fmt.Errorf("invalid matchers_condition: %v", err)
+	}
+
+	var compiled []Matcher
+	for _, matcher := range f.matchers() {
+		matcher, err := matcher.compile()
+		if err != nil {
+			return f, fmt.Errorf("invalid matcher: %v", err)
+		}
+		compiled = append(compiled, matcher)
+	}
+
+	f.compiled = compiled
+	return f, nil
+}
+
+// Compile every fingerprint in place, returning an error naming the first one that isn't well formed.
+func compileFingerprints(fingerprints []Fingerprint) error {
+	for i, fingerprint := range fingerprints {
+		compiled, err := fingerprint.compile()
+		if err != nil {
+			return fmt.Errorf("%s: %v", fingerprint.Service, err)
+		}
+		fingerprints[i] = compiled
+	}
+
+	return nil
+}
+
+// Get all matchers for a fingerprint, including ones for the can-i-take-over-xyz "fingerprint"
+// regex and "http_status" fields.
+func (f Fingerprint) matchers() []Matcher {
+	var matchers []Matcher
+	if f.Fingerprint != "" && !f.NXDomain {
+		matchers = append(matchers, Matcher{Type: MatchBody, Patterns: []string{f.Fingerprint}})
+	}
+
+	if f.HTTPStatus != 0 {
+		matchers = append(matchers, Matcher{Type: MatchStatus, Status: []int{f.HTTPStatus}})
+	}
+
+	return append(matchers, f.Matchers...)
+}
+
+// Check if a response matches the fingerprint. Matchers are combined with the fingerprint's
+// matchers condition, which defaults to "and". A fingerprint without matchers never matches.
+func (f Fingerprint) matchResponse(res *http.Response, body []byte) (bool, error) {
+	matchers := f.compiled
+	if matchers == nil {
+		matchers = f.matchers()
+	}
+	if len(matchers) == 0 {
+		return false, nil
+	}
+
+	or := normalizeCondition(f.MatchersCondition) == ConditionOr
+	for _, matcher := range matchers {
+		matched, err := matcher.match(res, body)
+		if err != nil {
+			return false, err
+		}
+
+		if or && matched {
+			return true, nil
+		}
+		if !or && !matched {
+			return false, nil
+		}
+	}
+
+	return !or, nil
+}
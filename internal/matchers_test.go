@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMatcherMatch(t *testing.T) {
+	res := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Header: http.Header{
+			"X-Amz-Error-Code": []string{"NoSuchBucket"},
+			"Server":           []string{"AmazonS3"},
+		},
+	}
+	body := []byte("<Error><Code>NoSuchBucket</Code><Message>The specified bucket does not exist</Message></Error>")
+
+	tests := []struct {
+		description string
+		matcher     Matcher
+		expected    bool
+	}{
+		{"status", Matcher{Type: MatchStatus, Status: []int{403, 404}}, true},
+		{"wrong status", Matcher{Type: MatchStatus, Status: []int{200}}, false},
+		{"negative status", Matcher{Type: MatchStatus, Status: []int{200}, Negative: true}, true},
+		{"header exists", Matcher{Type: MatchHeader, Name: "x-amz-error-code"}, true},
+		{"header missing", Matcher{Type: MatchHeader, Name: "x-ms-error-code"}, false},
+		{"header pattern", Matcher{Type: MatchHeader, Name: "x-amz-error-code", Patterns: []string{"^NoSuchBucket$"}}, true},
+		{"wrong header pattern", Matcher{Type: MatchHeader, Name: "x-amz-error-code", Patterns: []string{"AccessDenied"}}, false},
+		{"body or", Matcher{Type: MatchBody, Patterns: []string{"AccessDenied", "NoSuchBucket"}}, true},
+		{"body and", Matcher{Type: MatchBody, Patterns: []string{"NoSuchBucket", "does not exist"}, Condition: ConditionAnd}, true},
+		{"body and missing", Matcher{Type: MatchBody, Patterns: []string{"NoSuchBucket", "AccessDenied"}, Condition: ConditionAnd}, false},
+		{"negative body", Matcher{Type: MatchBody, Patterns: []string{"AccessDenied"}, Negative: true}, true},
+	}
+
+	for _, test := range tests {
+		got, err := test.matcher.match(res, body)
+		if err != nil {
+			t.Errorf("%s: %v", test.description, err)
+		}
+
+		if got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.description, test.expected, got)
+		}
+	}
+}
+
+func TestFingerprintMatchResponse(t *testing.T) {
+	res := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Header:     http.Header{"X-Ms-Error-Code": []string{"ContainerNotFound"}},
+	}
+	body := []byte("The specified container does not exist.")
+
+	tests := []struct {
+		description string
+		fingerprint Fingerprint
+		expected    bool
+	}{
+		{"upstream fingerprint", Fingerprint{Fingerprint: "container does not exist", HTTPStatus: 404}, true},
+		{"upstream wrong status", Fingerprint{Fingerprint: "container does not exist", HTTPStatus: 200}, false},
+		{"no matchers", Fingerprint{NXDomain: true, Fingerprint: "NXDOMAIN"}, false},
+		{"status and header", Fingerprint{Matchers: []Matcher{
+			{Type: MatchStatus, Status: []int{404}},
+			{Type: MatchHeader, Name: "x-ms-error-code", Patterns: []string{"ContainerNotFound"}},
+		}}, true},
+		{"status and wrong header", Fingerprint{Matchers: []Matcher{
+			{Type: MatchStatus, Status: []int{404}},
+			{Type: MatchHeader, Name: "x-ms-error-code", Patterns: []string{"BlobNotFound"}},
+		}}, false},
+		{"or", Fingerprint{MatchersCondition: ConditionOr, Matchers: []Matcher{
+			{Type: MatchStatus, Status: []int{200}},
+			{Type: MatchHeader, Name: "x-ms-error-code"},
+		}}, true},
+		{"uppercase or", Fingerprint{MatchersCondition: "OR", Matchers: []Matcher{
+			{Type: MatchStatus, Status: []int{200}},
+			{Type: MatchBody, Patterns: []string{"does not exist"}},
+		}}, true},
+		{"uppercase and patterns", Fingerprint{Matchers: []Matcher{
+			{Type: MatchBody, Patterns: []string{"container", "missing"}, Condition: "AND"},
+		}}, false},
+		{"upstream fingerprint and negative matcher", Fingerprint{Fingerprint: "does not exist", Matchers: []Matcher{
+			{Type: MatchHeader, Name: "x-ms-error-code", Patterns: []string{"ContainerNotFound"}, Negative: true},
+		}}, false},
+	}
+
+	for _, test := range tests {
+		got, err := test.fingerprint.matchResponse(res, body)
+		if err != nil {
+			t.Errorf("%s: %v", test.description, err)
+		}
+
+		if got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.description, test.expected, got)
+		}
+	}
+}
+
+func TestMatcherValidate(t *testing.T) {
+	invalid := []Matcher{
+		{Type: "cookie"},
+		{Type: MatchStatus},
+		{Type: MatchHeader, Patterns: []string{"x"}},
+		{Type: MatchBody},
+		{Type: MatchBody, Patterns: []string{"("}},
+		{Type: MatchBody, Patterns: []string{"x"}, Condition: "xor"},
+	}
+
+	for _, matcher := range invalid {
+		if err := matcher.validate(); err == nil {
+			t.Errorf("expected error for %+v", matcher)
+		}
+	}
+
+	valid := Matcher{Type: MatchHeader, Name: "x-amz-error-code", Patterns: []string{"NoSuchBucket"}, Condition: "AND"}
+	if err := valid.validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFingerprintValidate(t *testing.T) {
+	body := Matcher{Type: MatchBody, Patterns: []string{"x"}}
+
+	for _, condition := range []string{"", ConditionAnd, "Or"} {
+		if err := (Fingerprint{MatchersCondition: condition, Matchers: []Matcher{body}}).validate(); err != nil {
+			t.Errorf("expected %q to be valid, got %v", condition, err)
+		}
+	}
+
+	invalid := []Fingerprint{
+		{MatchersCondition: "any", Matchers: []Matcher{body}},
+		{Matchers: []Matcher{{Type: MatchBody}}},
+	}
+	for _, fingerprint := range invalid {
+		if err := fingerprint.validate(); err == nil {
+			t.Errorf("expected error for %+v", fingerprint)
+		}
+	}
+}
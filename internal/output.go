@@ -1,17 +1,174 @@
 package internal
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
 
-func ToConsole(result Result, verbose bool) {
+// Output formats
+const (
+	FormatConsole = "console"
+	// A single JSON array of every result
+	FormatJSON = "json"
+	// One JSON object per line, written as results come in
+	FormatJSONL = "jsonl"
+	// A SARIF 2.1.0 log of the vulnerable results
+	FormatSARIF = "sarif"
+	// A single static HTML report of the findings
+	FormatHTML = "html"
+	// One CSV row per primary and secondary URL pair
+	FormatCSV = "csv"
+)
+
+// Writes results in an output format. Close must be called once every result has been written,
+// since some formats can only be written out in full.
+type Writer interface {
+	Write(result Result) error
+	Close() error
+}
+
+// Options for the writers. Each format ignores the options that aren't for it.
+type WriterOptions struct {
+	// Console: print every scanned URL, even if not vulnerable
+	Verbose bool
+	// Console: print URLs that couldn't be scanned
+	ShowErrors bool
+	// SARIF: services to add a rule for, even without a finding, usually from ScanServices
+	Services []string
+}
+
+// Create a Writer for the format that writes to out.
+func NewWriter(format string, out io.Writer, options WriterOptions) (Writer, error) {
+	switch strings.ToLower(format) {
+	case "", FormatConsole:
+		return &consoleWriter{out: out, options: options}, nil
+	case FormatJSON:
+		return &jsonWriter{out: out}, nil
+	case FormatJSONL:
+		return &jsonWriter{out: out, lines: true}, nil
+	case FormatSARIF:
+		return newSARIFWriter(out, options.Services), nil
+	case FormatHTML:
+		return newHTMLWriter(out), nil
+	case FormatCSV:
+		return newCSVWriter(out), nil
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected one of console, json, jsonl, sarif, html or csv", format)
+	}
+}
+
+type consoleWriter struct {
+	out     io.Writer
+	options WriterOptions
+}
+
+func (w *consoleWriter) Write(result Result) error {
+	writeConsole(w.out, result, w.options.Verbose, w.options.ShowErrors)
+	return nil
+}
+
+func (w *consoleWriter) Close() error {
+	return nil
+}
+
+// Print a result. Errors are only printed, to stderr, if showErrors is set, since they
+// are counted in the Summary either way.
+func ToConsole(result Result, verbose bool, showErrors bool) {
+	writeConsole(os.Stdout, result, verbose, showErrors)
+}
+
+func writeConsole(out io.Writer, result Result, verbose bool, showErrors bool) {
 	if result.Error != nil {
-		panic(fmt.Errorf("error with result:\nSource URL: %s\nSecondary URL: %s\nError: %v", result.PrimaryURL, result.SecondaryURL, result.Error.Error()))
+		if showErrors {
+			fmt.Fprintf(os.Stderr, "Error scanning url: Source URL - %s, Secondary URL - %s, Error - %v%s\n",
+				result.PrimaryURL, result.SecondaryURL, result.Error, attemptsNote(result))
+		}
+		return
 	}
-	
+
 	if result.Vulnerable {
-		fmt.Printf("Found possibly vulnerable url: Source URL - %s, Vulnerable URL - %s\n", result.PrimaryURL, result.SecondaryURL)
+		fmt.Fprintf(out, "Found possibly vulnerable url: Source URL - %s, Vulnerable URL - %s, Directive - %s, Severity - %s%s%s\n",
+			result.PrimaryURL, result.SecondaryURL, result.Directive, result.Severity, reportOnlyNote(result), viaNote(result))
+	}
+
+	if result.Bucket != nil && result.Bucket.State == BucketPublicListable {
+		fmt.Fprintf(out, "Found publicly listable bucket: Source URL - %s, Bucket URL - %s\n", result.PrimaryURL, result.SecondaryURL)
 	}
 
 	if verbose {
-		fmt.Printf("Scanned URL: %s\n", result.SecondaryURL)
+		fmt.Fprintf(out, "Scanned URL: %s\n", result.SecondaryURL)
+	}
+}
+
+func viaNote(result Result) string {
+	via := result.Via()
+	if len(via) == 0 {
+		return ""
+	}
+	return ", Via - " + strings.Join(via, " -> ")
+}
+
+func attemptsNote(result Result) string {
+	if result.Attempts > 1 {
+		return fmt.Sprintf(" (after %d attempts)", result.Attempts)
+	}
+	return ""
+}
+
+func reportOnlyNote(result Result) string {
+	if result.ReportOnly {
+		return " (report-only)"
+	}
+	return ""
+}
+
+// Counts of the results from a scan.
+type Summary struct {
+	// Results checked, including ones that failed
+	Scanned    int
+	Vulnerable int
+	// Failed results by kind
+	Errors map[ErrorKind]int
+}
+
+// Count a result in the summary.
+func (s *Summary) Add(result Result) {
+	s.Scanned++
+	if result.Vulnerable {
+		s.Vulnerable++
+	}
+
+	if result.Error != nil {
+		if s.Errors == nil {
+			s.Errors = map[ErrorKind]int{}
+		}
+		s.Errors[classifyError(result.Error)]++
+	}
+}
+
+// Total number of failed results.
+func (s Summary) ErrorCount() int {
+	total := 0
+	for _, count := range s.Errors {
+		total += count
+	}
+	return total
+}
+
+// Print the summary to stderr, so it isn't mixed in with the findings.
+func (s Summary) ToConsole() {
+	fmt.Fprintf(os.Stderr, "Scanned %d URLs, found %d possibly vulnerable, %d errors\n", s.Scanned, s.Vulnerable, s.ErrorCount())
+
+	var kinds []string
+	for kind := range s.Errors {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+
+	for _, kind := range kinds {
+		fmt.Fprintf(os.Stderr, "  %s: %d\n", kind, s.Errors[ErrorKind(kind)])
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,217 @@
+package internal
+
+import (
+	URL "net/url"
+	"regexp"
+	"strings"
+)
+
+type SourceKind string
+
+// Kinds of values in a CSP directive
+const (
+	// Quoted keyword, like 'self', 'none' or 'unsafe-inline'
+	SourceKeyword SourceKind = "keyword"
+	// 'nonce-...'
+	SourceNonce SourceKind = "nonce"
+	// 'sha256-...', 'sha384-...' or 'sha512-...'
+	SourceHash SourceKind = "hash"
+	// Scheme only, like https: or data:
+	SourceScheme SourceKind = "scheme"
+	// Host, with an optional scheme, port and path, like https://*.example.com:443/path
+	SourceHost SourceKind = "host"
+	// A bare * matching any URL
+	SourceWildcard SourceKind = "wildcard"
+	// Anything else, like sandbox flags, trusted types policy names or relative report-uri paths
+	SourceValue SourceKind = "value"
+)
+
+// Directives whose values are not source expressions, so they are never parsed as hosts
+var nonSourceListDirectives = map[string]bool{
+	"sandbox":                   true,
+	"trusted-types":             true,
+	"require-trusted-types-for": true,
+	"report-to":                 true,
+	"plugin-types":              true,
+}
+
+var (
+	schemeSourceRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*:$`)
+	hostRegex         = regexp.MustCompile(`^(?:\*|(?:\*\.)?[a-zA-Z0-9-]+(?:\.[a-zA-Z0-9-]+)*\.?)$`)
+	portRegex         = regexp.MustCompile(`^(?:\*|[0-9]+)$`)
+)
+
+// A single value in a CSP directive.
+type Source struct {
+	Kind SourceKind
+	// Name of the directive the source appeared in, like "script-src"
+	Directive string
+	// The source as it appeared in the policy
+	Raw string
+	// Scheme without the trailing colon, for host and scheme sources
+	Scheme string
+	Host   string
+	Port   string
+	Path   string
+	// The host starts with a "*." wildcard, or is just "*"
+	WildcardHost bool
+	// The port is ":*"
+	WildcardPort bool
+}
+
+// A directive and its sources, like "script-src 'self' https://cdn.example.com".
+type Directive struct {
+	// Lowercase directive name
+	Name    string
+	Sources []Source
+}
+
+// A parsed Content Security Policy, along with how it was delivered.
+type Policy struct {
+	Directives []Directive
+	// Header the policy was delivered in, or the http-equiv name for <meta> policies
+	Header string
+	// The policy is only reported on, not enforced
+	ReportOnly bool
+	// How the policy was delivered, either DeliveryHeader or DeliveryMeta
+	Delivery string
+}
+
+// Parse a single source expression from a directive.
+func ParseSource(directive string, raw string) Source {
+	source := Source{Kind: SourceValue, Directive: directive, Raw: raw}
+	if nonSourceListDirectives[directive] {
+		return source
+	}
+
+	lower := strings.ToLower(raw)
+	switch {
+	case len(raw) > 1 && strings.HasPrefix(raw, "'") && strings.HasSuffix(raw, "'"):
+		switch {
+		case strings.HasPrefix(lower, "'nonce-"):
+			source.Kind = SourceNonce
+		case strings.HasPrefix(lower, "'sha256-"), strings.HasPrefix(lower, "'sha384-"), strings.HasPrefix(lower, "'sha512-"):
+			source.Kind = SourceHash
+		default:
+			source.Kind = SourceKeyword
+		}
+		return source
+	case raw == "*":
+		source.Kind = SourceWildcard
+		return source
+	case schemeSourceRegex.MatchString(raw):
+		source.Kind = SourceScheme
+		source.Scheme = strings.TrimSuffix(lower, ":")
+		return source
+	}
+
+	rest := raw
+	scheme := ""
+	if before, after, found := strings.Cut(raw, "://"); found {
+		if !schemeSourceRegex.MatchString(before + ":") {
+			return source
+		}
+		scheme = strings.ToLower(before)
+		rest = after
+	}
+
+	hostPort, path := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		hostPort, path = rest[:i], rest[i:]
+	}
+
+	host, port, hasPort := strings.Cut(hostPort, ":")
+	if !hostRegex.MatchString(host) || (hasPort && !portRegex.MatchString(port)) {
+		return source
+	}
+
+	source.Kind = SourceHost
+	source.Scheme = scheme
+	source.Host = host
+	source.Port = port
+	source.Path = path
+	source.WildcardHost = host == "*" || strings.HasPrefix(host, "*.")
+	source.WildcardPort = port == "*"
+	return source
+}
+
+// Get the URL a host source points at, for checking if it can be taken over. Wildcard hosts
+// and hosts without a TLD have no single URL, and wildcard ports are dropped. Sources
+// without a scheme use https.
+func (s Source) URL() (string, bool) {
+	if s.Kind != SourceHost || s.WildcardHost || !strings.Contains(s.Host, ".") {
+		return "", false
+	}
+
+	scheme := s.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+
+	host := s.Host
+	if s.Port != "" && !s.WildcardPort {
+		host += ":" + s.Port
+	}
+
+	parsedURL, err := URL.Parse(scheme + "://" + host + s.Path)
+	if err != nil || parsedURL.Host == "" {
+		return "", false
+	}
+
+	return parsedURL.String(), true
+}
+
+// Parse a single policy, like the value of one Content-Security-Policy header. Directive names
+// are lowercased, but sources are kept as they appeared so the policy can be serialized again.
+func ParsePolicy(csp string) Policy {
+	var policy Policy
+	for _, rawDirective := range strings.Split(csp, ";") {
+		tokens := strings.Fields(rawDirective)
+		if len(tokens) == 0 {
+			continue
+		}
+
+		directive := Directive{Name: strings.ToLower(tokens[0])}
+		for _, token := range tokens[1:] {
+			directive.Sources = append(directive.Sources, ParseSource(directive.Name, token))
+		}
+
+		policy.Directives = append(policy.Directives, directive)
+	}
+
+	return policy
+}
+
+// Serialize the directive, like "script-src 'self' https://cdn.example.com".
+func (d Directive) String() string {
+	parts := []string{d.Name}
+	for _, source := range d.Sources {
+		parts = append(parts, source.Raw)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// Serialize the policy. Parsing the result with ParsePolicy gives back the same policy.
+func (p Policy) String() string {
+	var directives []string
+	for _, directive := range p.Directives {
+		directives = append(directives, directive.String())
+	}
+
+	return strings.Join(directives, "; ")
+}
+
+// Get every source in the policy that points at a URL, in the order they appear.
+func (p Policy) URLSources() []Source {
+	var sources []Source
+	for _, directive := range p.Directives {
+		for _, source := range directive.Sources {
+			if _, ok := source.URL(); ok {
+				sources = append(sources, source)
+			}
+		}
+	}
+
+	return sources
+}
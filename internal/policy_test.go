@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		directive string
+		raw       string
+		expected  Source
+	}{
+		{"script-src", "'self'", Source{Kind: SourceKeyword}},
+		{"script-src", "'UNSAFE-INLINE'", Source{Kind: SourceKeyword}},
+		{"script-src", "'nonce-r4nd0m'", Source{Kind: SourceNonce}},
+		{"script-src", "'sha256-abc+/='", Source{Kind: SourceHash}},
+		{"img-src", "data:", Source{Kind: SourceScheme, Scheme: "data"}},
+		{"default-src", "*", Source{Kind: SourceWildcard}},
+		{"script-src", "example.com", Source{Kind: SourceHost, Host: "example.com"}},
+		{"script-src", "https://cdn.example.com:8443/js/", Source{Kind: SourceHost, Scheme: "https", Host: "cdn.example.com", Port: "8443", Path: "/js/"}},
+		{"script-src", "http://*.example.com:*", Source{Kind: SourceHost, Scheme: "http", Host: "*.example.com", Port: "*", WildcardHost: true, WildcardPort: true}},
+		{"script-src", "wss://*", Source{Kind: SourceHost, Scheme: "wss", Host: "*", WildcardHost: true}},
+		{"report-uri", "/csp-report", Source{Kind: SourceValue}},
+		{"sandbox", "allow-scripts", Source{Kind: SourceValue}},
+		{"trusted-types", "my.policy", Source{Kind: SourceValue}},
+		{"script-src", "https://exa mple.com", Source{Kind: SourceValue}},
+		{"script-src", "example.com:http", Source{Kind: SourceValue}},
+	}
+
+	for _, test := range tests {
+		expected := test.expected
+		expected.Directive = test.directive
+		expected.Raw = test.raw
+
+		got := ParseSource(test.directive, test.raw)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s %s: expected %+v, got %+v", test.directive, test.raw, expected, got)
+		}
+	}
+}
+
+func TestSourceURL(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected string
+		ok       bool
+	}{
+		{"example.com", "https://example.com", true},
+		{"http://scripts.example.org", "http://scripts.example.org", true},
+		{"https://example.org:5443", "https://example.org:5443", true},
+		{"http://test.example.org:*/path", "http://test.example.org/path", true},
+		{"http://*.example.org", "", false},
+		{"localhost", "", false},
+		{"'self'", "", false},
+		{"https:", "", false},
+	}
+
+	for _, test := range tests {
+		got, ok := ParseSource("script-src", test.raw).URL()
+		if got != test.expected || ok != test.ok {
+			t.Errorf("%s: expected %q (%v), got %q (%v)", test.raw, test.expected, test.ok, got, ok)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	csp := "default-src 'self'; Script-Src 'nonce-abc' https://cdn.example.com;; img-src data: *.example.com ;upgrade-insecure-requests"
+	policy := ParsePolicy(csp)
+
+	var names []string
+	for _, directive := range policy.Directives {
+		names = append(names, directive.Name)
+	}
+
+	expectedNames := []string{"default-src", "script-src", "img-src", "upgrade-insecure-requests"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("expected directives %v, got %v", expectedNames, names)
+	}
+
+	expected := "default-src 'self'; script-src 'nonce-abc' https://cdn.example.com; img-src data: *.example.com; upgrade-insecure-requests"
+	if policy.String() != expected {
+		t.Errorf("expected %q, got %q", expected, policy.String())
+	}
+
+	// Serializing and parsing again gives back the same policy
+	if !reflect.DeepEqual(ParsePolicy(policy.String()), policy) {
+		t.Error("policy did not round-trip")
+	}
+
+	sources := policy.URLSources()
+	if len(sources) != 1 || sources[0].Directive != "script-src" || sources[0].Host != "cdn.example.com" {
+		t.Errorf("expected only the script-src host source, got %+v", sources)
+	}
+}
@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on how fast requests are sent. Zero values mean no limit.
+type RateLimitOptions struct {
+	// Requests per second to a single host
+	HostRPS float64
+	// Requests in flight to a single host at once, including reading the response body
+	HostConcurrency int
+	// Requests per second across every host
+	GlobalRPS float64
+	// Random delay of up to Jitter added before each request, so requests don't go out in lockstep
+	Jitter time.Duration
+}
+
+// Spaces out calls so that at most rps happen per second. The first call never waits.
+type intervalLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func newIntervalLimiter(rps float64) *intervalLimiter {
+	return &intervalLimiter{interval: time.Duration(float64(time.Second) / rps)}
+}
+
+// Reserve the next slot and wait for it, or until ctx is done. A slot given up because ctx is done
+// is handed back if nobody has reserved one after it, so cancelled waits don't slow down the next caller.
+func (l *intervalLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	end := at.Add(l.interval)
+	l.next = end
+	l.mu.Unlock()
+
+	err := sleep(ctx, at.Sub(now))
+	if err != nil {
+		l.mu.Lock()
+		if l.next.Equal(end) {
+			l.next = at
+		}
+		l.mu.Unlock()
+	}
+	return err
+}
+
+// Sleep for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Limits requests per host and across every host. Safe for concurrent use. Use Transport to
+// apply it to every request a client sends.
+type RateLimiter struct {
+	options RateLimitOptions
+	global  *intervalLimiter
+
+	mu          sync.Mutex
+	hostLimits  map[string]*intervalLimiter
+	hostWorkers map[string]chan struct{}
+}
+
+func NewRateLimiter(options RateLimitOptions) *RateLimiter {
+	limiter := &RateLimiter{
+		options:     options,
+		hostLimits:  map[string]*intervalLimiter{},
+		hostWorkers: map[string]chan struct{}{},
+	}
+	if options.GlobalRPS > 0 {
+		limiter.global = newIntervalLimiter(options.GlobalRPS)
+	}
+	return limiter
+}
+
+// Get the per host limiter and semaphore for a host, creating them on first use.
+func (l *RateLimiter) host(host string) (*intervalLimiter, chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	limit, ok := l.hostLimits[host]
+	if !ok && l.options.HostRPS > 0 {
+		limit = newIntervalLimiter(l.options.HostRPS)
+		l.hostLimits[host] = limit
+	}
+
+	workers, ok := l.hostWorkers[host]
+	if !ok && l.options.HostConcurrency > 0 {
+		workers = make(chan struct{}, l.options.HostConcurrency)
+		l.hostWorkers[host] = workers
+	}
+
+	return limit, workers
+}
+
+// Wait until a request to host is allowed. The returned release function must be called once the
+// request is done, to free its slot in the host's concurrency limit.
+func (l *RateLimiter) Wait(ctx context.Context, host string) (func(), error) {
+	limit, workers := l.host(strings.ToLower(host))
+
+	release := func() {}
+	if workers != nil {
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+			return release, ctx.Err()
+		}
+
+		var once sync.Once
+		release = func() {
+			once.Do(func() { <-workers })
+		}
+	}
+
+	for _, limiter := range []*intervalLimiter{limit, l.global} {
+		if limiter == nil {
+			continue
+		}
+		if err := limiter.wait(ctx); err != nil {
+			release()
+			return func() {}, err
+		}
+	}
+
+	if l.options.Jitter > 0 {
+		if err := sleep(ctx, rand.N(l.options.Jitter)); err != nil {
+			release()
+			return func() {}, err
+		}
+	}
+
+	return release, nil
+}
+
+// Wrap a transport so every request waits for the rate limiter. base defaults to http.DefaultTransport.
+func (l *RateLimiter) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &rateLimitedTransport{base: base, limiter: l}
+}
+
+type rateLimitedTransport struct {
+	base    http.RoundTripper
+	limiter *RateLimiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := t.limiter.Wait(req.Context(), req.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// The request is still in flight until its body has been read and closed
+	res.Body = &releaseOnClose{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterHostRPS(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitOptions{HostRPS: 20})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		release, err := limiter.Wait(context.Background(), "a.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+
+	// The first request goes straight out, and the other 4 are 50ms apart
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("expected 5 requests at 20 rps to take at least 200ms, took %s", elapsed)
+	}
+
+	// Other hosts have their own limit
+	start = time.Now()
+	release, err := limiter.Wait(context.Background(), "b.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Errorf("expected a new host to not wait, waited %s", elapsed)
+	}
+}
+
+func TestRateLimiterGlobalRPS(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitOptions{GlobalRPS: 20})
+
+	start := time.Now()
+	for _, host := range []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"} {
+		release, err := limiter.Wait(context.Background(), host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("expected 4 requests at 20 rps to take at least 150ms across hosts, took %s", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	limiter := NewRateLimiter(RateLimitOptions{HostRPS: 0.1})
+	release, err := limiter.Wait(context.Background(), "a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.Wait(ctx, "a.example.com"); err == nil {
+		t.Error("expected waiting to stop when the context is done")
+	}
+}
+
+func TestIntervalLimiterCancelRefunds(t *testing.T) {
+	limiter := newIntervalLimiter(0.1)
+	if err := limiter.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	next := limiter.next
+
+	// The slot given up by a cancelled wait goes to the next caller
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := limiter.wait(ctx); err == nil {
+		t.Fatal("expected waiting to stop when the context is done")
+	}
+	if !limiter.next.Equal(next) {
+		t.Errorf("expected the cancelled slot to be refunded, next slot moved from %s to %s", next, limiter.next)
+	}
+}
+
+func TestRateLimiterTransportHostConcurrency(t *testing.T) {
+	const limit = 2
+	var active, maxActive atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := active.Add(1)
+		defer active.Add(-1)
+		for {
+			seen := maxActive.Load()
+			if current <= seen || maxActive.CompareAndSwap(seen, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	limiter := NewRateLimiter(RateLimitOptions{HostConcurrency: limit, Jitter: time.Millisecond})
+	client := &http.Client{Transport: limiter.Transport(nil)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(server.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+
+	if maxActive.Load() > limit {
+		t.Errorf("expected at most %d requests at once, got %d", limit, maxActive.Load())
+	}
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Resolver performs the DNS lookups used by CheckURL. *net.Resolver satisfies this interface,
+// so the system and custom nameserver resolvers are both thin wrappers around it.
+type Resolver interface {
+	LookupCNAME(ctx context.Context, host string) (string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupNS(ctx context.Context, host string) ([]*net.NS, error)
+}
+
+// Create a resolver that uses the nameservers configured on the host (e.g. /etc/resolv.conf).
+// The pure Go resolver is preferred so that CNAME records are followed one hop at a time
+// regardless of the platform's C library.
+func NewSystemResolver() Resolver {
+	return &net.Resolver{PreferGo: true}
+}
+
+// Create a resolver that only sends queries to the provided nameservers, rotating between them.
+// Nameservers without a port use port 53.
+//
+// Parameters:
+//   - nameservers: List of nameserver addresses, like "1.1.1.1" or "8.8.8.8:53".
+func NewNameserverResolver(nameservers []string) Resolver {
+	var addresses []string
+	for _, nameserver := range nameservers {
+		nameserver = strings.TrimSpace(nameserver)
+		if nameserver == "" {
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(nameserver); err != nil {
+			nameserver = net.JoinHostPort(nameserver, "53")
+		}
+		addresses = append(addresses, nameserver)
+	}
+
+	if len(addresses) == 0 {
+		return NewSystemResolver()
+	}
+
+	var next uint64
+	dialer := net.Dialer{Timeout: 5 * time.Second}
+
+	return &net.Resolver{
+		PreferGo: true,
+		// Ignore the nameserver picked from the system config and use the next configured one instead
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			address := addresses[atomic.AddUint64(&next, 1)%uint64(len(addresses))]
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// Check if a DNS error means that the name does not exist, rather than the lookup failing.
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
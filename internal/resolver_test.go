@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+// In-memory Resolver so that DNS dependent checks can be tested deterministically.
+// Hosts that aren't in any of the maps are treated as NXDOMAIN.
+type fakeResolver struct {
+	cnames map[string]string
+	hosts  map[string][]string
+	ns     map[string][]string
+}
+
+func (r fakeResolver) exists(host string) bool {
+	_, isCname := r.cnames[host]
+	_, isHost := r.hosts[host]
+	return isCname || isHost
+}
+
+func (r fakeResolver) LookupCNAME(ctx context.Context, host string) (string, error) {
+	if target, ok := r.cnames[host]; ok {
+		return target + ".", nil
+	}
+
+	if !r.exists(host) {
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	// Like net.Resolver, hosts without a CNAME return their own name
+	return host + ".", nil
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	for i := 0; i < maxCNAMEDepth; i++ {
+		target, ok := r.cnames[host]
+		if !ok {
+			break
+		}
+		host = target
+	}
+
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return addrs, nil
+}
+
+func (r fakeResolver) LookupNS(ctx context.Context, host string) ([]*net.NS, error) {
+	nameservers, ok := r.ns[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	var out []*net.NS
+	for _, nameserver := range nameservers {
+		out = append(out, &net.NS{Host: nameserver + "."})
+	}
+
+	return out, nil
+}
+
+func TestNewNameserverResolver(t *testing.T) {
+	// No usable nameservers should fall back to the system resolver rather than failing every lookup
+	resolver, ok := NewNameserverResolver([]string{"", " "}).(*net.Resolver)
+	if !ok || resolver.Dial != nil {
+		t.Error("expected system resolver when no nameservers are provided")
+	}
+
+	resolver, ok = NewNameserverResolver([]string{"1.1.1.1", "8.8.8.8:53"}).(*net.Resolver)
+	if !ok || resolver.Dial == nil || !resolver.PreferGo {
+		t.Error("expected pure Go resolver with custom dialer")
+	}
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How failed requests are retried.
+type RetryOptions struct {
+	// Retries after the first attempt, 0 to never retry
+	MaxRetries int
+	// Delay before the first retry, doubled for each retry after it
+	BaseDelay time.Duration
+	// Longest delay between attempts, including delays asked for with Retry-After
+	MaxDelay time.Duration
+}
+
+// Maximum size of a failed response body that is read before retrying, so the connection can be reused
+const maxDrainSize = 64 << 10
+
+// Check if a request error is temporary, so the request may work if it is sent again.
+// Connection resets and timeouts are temporary, while DNS, TLS and refused connections are permanent.
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Check if a response status means the request may work if it is sent again. 501 and 505
+// mean the server will never support the request, so they aren't retried.
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported:
+		return false
+	default:
+		return status >= 500 && status <= 599
+	}
+}
+
+// Get the delay a response asks for in its Retry-After header, either in seconds or as a date.
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0), true
+	}
+
+	return 0, false
+}
+
+// Get the delay before a retry, doubling for each attempt, with jitter so retries to the same
+// host are spread out. The delay is between half and all of the doubled delay.
+func (o RetryOptions) backoff(attempt int) time.Duration {
+	delay := o.BaseDelay << (attempt - 1)
+	if delay <= 0 || (o.MaxDelay > 0 && delay > o.MaxDelay) {
+		delay = o.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Records the most attempts any request took, for requests sent with a context from withAttemptCounter.
+type attemptCounter struct {
+	mu  sync.Mutex
+	max int
+}
+
+type attemptCounterKey struct{}
+
+// Add an attempt counter to ctx, which the retry transport records every request sent with the context in.
+func withAttemptCounter(ctx context.Context) (context.Context, *attemptCounter) {
+	counter := &attemptCounter{}
+	return context.WithValue(ctx, attemptCounterKey{}, counter), counter
+}
+
+func (c *attemptCounter) record(attempts int) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max = max(c.max, attempts)
+}
+
+// Get the most attempts any request took, or 0 if no request was sent.
+func (c *attemptCounter) attempts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.max
+}
+
+// Wrap a transport so failed GET and HEAD requests are retried with exponential backoff.
+// Connection resets, timeouts, 429 and 5xx responses are retried, and Retry-After is respected.
+// base defaults to http.DefaultTransport.
+func NewRetryTransport(base http.RoundTripper, options RetryOptions) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryTransport{base: base, options: options}
+}
+
+type retryTransport struct {
+	base    http.RoundTripper
+	options RetryOptions
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	counter, _ := ctx.Value(attemptCounterKey{}).(*attemptCounter)
+	// Only requests without a body can safely be sent again
+	idempotent := (req.Method == http.MethodGet || req.Method == http.MethodHead) && req.Body == nil
+
+	for attempt := 1; ; attempt++ {
+		counter.record(attempt)
+		res, err := t.base.RoundTrip(req.Clone(ctx))
+		if attempt > t.options.MaxRetries || !idempotent {
+			return res, err
+		}
+
+		delay := t.options.backoff(attempt)
+		if err != nil {
+			if !isRetryableError(err) || ctx.Err() != nil {
+				return nil, err
+			}
+		} else {
+			if !isRetryableStatus(res.StatusCode) {
+				return res, nil
+			}
+
+			if after, ok := retryAfter(res); ok {
+				delay = after
+				if t.options.MaxDelay > 0 && delay > t.options.MaxDelay {
+					delay = t.options.MaxDelay
+				}
+			}
+
+			io.Copy(io.Discard, io.LimitReader(res.Body, maxDrainSize))
+			res.Body.Close()
+		}
+
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func retryClient(maxRetries int) *http.Client {
+	return &http.Client{Transport: NewRetryTransport(nil, RetryOptions{
+		MaxRetries: maxRetries,
+		BaseDelay:  time.Millisecond,
+		MaxDelay:   50 * time.Millisecond,
+	})}
+}
+
+// Get url with an attempt counter, returning the status and the attempts recorded.
+func getWithAttempts(t *testing.T, client *http.Client, url string) (int, int) {
+	t.Helper()
+	ctx, counter := withAttemptCounter(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode, counter.attempts()
+}
+
+func TestRetryTransportRetriesServerErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	status, attempts := getWithAttempts(t, retryClient(2), server.URL)
+	if status != http.StatusOK {
+		t.Errorf("expected 200 after retrying, got %d", status)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestRetryTransportGivesUp(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	status, attempts := getWithAttempts(t, retryClient(2), server.URL)
+	if status != http.StatusBadGateway {
+		t.Errorf("expected the last 502 to be returned, got %d", status)
+	}
+	if attempts != 3 || requests.Load() != 3 {
+		t.Errorf("expected 3 attempts, got %d attempts and %d requests", attempts, requests.Load())
+	}
+}
+
+func TestRetryTransportPermanentStatus(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusForbidden, http.StatusNotImplemented} {
+		var requests atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(status)
+		}))
+
+		got, attempts := getWithAttempts(t, retryClient(2), server.URL)
+		if got != status || attempts != 1 || requests.Load() != 1 {
+			t.Errorf("expected a single attempt for %d, got status %d after %d attempts", status, got, attempts)
+		}
+		server.Close()
+	}
+}
+
+func TestRetryTransportRetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// Retry-After is capped at MaxDelay
+	client := &http.Client{Transport: NewRetryTransport(nil, RetryOptions{
+		MaxRetries: 1,
+		BaseDelay:  time.Millisecond,
+		MaxDelay:   200 * time.Millisecond,
+	})}
+
+	start := time.Now()
+	status, attempts := getWithAttempts(t, client, server.URL)
+	elapsed := time.Since(start)
+	if status != http.StatusOK || attempts != 2 {
+		t.Errorf("expected 200 after 2 attempts, got %d after %d", status, attempts)
+	}
+	if elapsed < 190*time.Millisecond || elapsed > time.Second {
+		t.Errorf("expected Retry-After to be respected up to the 200ms cap, took %s", elapsed)
+	}
+}
+
+func TestRetryTransportConnectionReset(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// Close the connection without a response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	status, attempts := getWithAttempts(t, retryClient(2), server.URL)
+	if status != http.StatusOK || attempts != 2 {
+		t.Errorf("expected 200 after 2 attempts, got %d after %d", status, attempts)
+	}
+}
+
+func TestRetryTransportNoRetries(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	status, attempts := getWithAttempts(t, retryClient(0), server.URL)
+	if status != http.StatusServiceUnavailable || attempts != 1 || requests.Load() != 1 {
+		t.Errorf("expected a single attempt with retries disabled, got %d after %d", status, attempts)
+	}
+}
+
+func TestRetryTransportCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "10")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewRetryTransport(nil, RetryOptions{MaxRetries: 2, MaxDelay: time.Minute})}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+
+	start := time.Now()
+	_, err := client.Do(req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait for a retry to be aborted, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the retry to be aborted straight away, took %s", elapsed)
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{fmt.Errorf("request failed: %w", io.ErrUnexpectedEOF), true},
+		{&net.DNSError{Err: "timeout", Name: "example.com", IsTimeout: true}, true},
+		{&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, true},
+		{errors.New("x509: certificate signed by unknown authority"), false},
+	}
+
+	for _, test := range tests {
+		if got := isRetryableError(test.err); got != test.retryable {
+			t.Errorf("isRetryableError(%v) = %v, expected %v", test.err, got, test.retryable)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	res := &http.Response{Header: http.Header{}}
+	if _, ok := retryAfter(res); ok {
+		t.Error("expected no delay without a Retry-After header")
+	}
+
+	res.Header.Set("Retry-After", "5")
+	if delay, ok := retryAfter(res); !ok || delay != 5*time.Second {
+		t.Errorf("expected 5s, got %s", delay)
+	}
+
+	res.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if delay, ok := retryAfter(res); !ok || delay < 55*time.Second || delay > time.Minute {
+		t.Errorf("expected about a minute, got %s", delay)
+	}
+
+	res.Header.Set("Retry-After", "soon")
+	if _, ok := retryAfter(res); ok {
+		t.Error("expected an invalid Retry-After to be ignored")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	options := RetryOptions{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		for i := 0; i < 20; i++ {
+			if delay := options.backoff(attempt); delay < max/2 || delay > max {
+				t.Errorf("expected the delay for attempt %d to be between %s and %s, got %s", attempt, max/2, max, delay)
+			}
+		}
+	}
+}
+
+func TestProcessPrimaryURLsRecordsAttempts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+
+	urlsChannel := make(chan Result, 1)
+	go ProcessPrimaryURLs(context.Background(), targets([]string{server.URL}), urlsChannel, 1, retryClient(2), CSPOptions{Method: MethodGet}, 0)
+
+	var results []Result
+	for result := range urlsChannel {
+		results = append(results, result)
+	}
+	if len(results) != 1 || results[0].Error == nil {
+		t.Fatalf("expected a single error result, got %+v", results)
+	}
+	if results[0].Attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", results[0].Attempts)
+	}
+
+	var scanErr *ScanError
+	if !errors.As(results[0].Error, &scanErr) || !scanErr.Retryable {
+		t.Errorf("expected a retryable error, got %v", results[0].Error)
+	}
+}
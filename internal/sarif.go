@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+)
+
+// Subset of the SARIF 2.1.0 log format that cspscan writes.
+type sarifLog struct {
+	Version string     `json:"version"`
+	Schema  string     `json:"$schema"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	Name             string       `json:"name"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+	FullDescription  sarifMessage `json:"fullDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID           string          `json:"ruleId"`
+	RuleIndex        int             `json:"ruleIndex"`
+	Level            string          `json:"level"`
+	Message          sarifMessage    `json:"message"`
+	Locations        []sarifLocation `json:"locations"`
+	RelatedLocations []sarifLocation `json:"relatedLocations,omitempty"`
+	Properties       sarifProperties `json:"properties"`
+}
+
+type sarifLocation struct {
+	ID               int                    `json:"id,omitempty"`
+	PhysicalLocation *sarifPhysicalLocation `json:"physicalLocation,omitempty"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+	Message          *sarifMessage          `json:"message,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifLogicalLocation struct {
+	Name               string `json:"name"`
+	FullyQualifiedName string `json:"fullyQualifiedName"`
+	Kind               string `json:"kind"`
+}
+
+type sarifProperties struct {
+	Severity     string   `json:"severity"`
+	SecondaryURL string   `json:"secondaryUrl"`
+	Header       string   `json:"header,omitempty"`
+	ReportOnly   bool     `json:"reportOnly,omitempty"`
+	Evidence     []string `json:"evidence,omitempty"`
+	Chain        []string `json:"chain,omitempty"`
+}
+
+var sarifRuleIDRegex = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Get the rule ID for a service, like "takeover/microsoft-azure".
+func sarifRuleID(service string) string {
+	slug := strings.Trim(sarifRuleIDRegex.ReplaceAllString(strings.ToLower(service), "-"), "-")
+	if slug == "" {
+		slug = "unknown"
+	}
+	return "takeover/" + slug
+}
+
+// Map a severity to a SARIF result level.
+func sarifLevel(severity Severity) string {
+	switch severity {
+	case SeverityHigh:
+		return "error"
+	case SeverityMedium:
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+// Writes vulnerable results as a SARIF 2.1.0 log once closed, with one rule per service the
+// scan checks for, and for any other service that had a finding. Results that aren't vulnerable are left out.
+type sarifWriter struct {
+	out   io.Writer
+	run   sarifRun
+	rules map[string]int
+}
+
+func newSARIFWriter(out io.Writer, services []string) *sarifWriter {
+	writer := &sarifWriter{
+		out: out,
+		run: sarifRun{
+			Tool: sarifTool{Driver: sarifDriver{
+				Name:           "cspscan",
+				InformationURI: "https://github.com/osm6495/cspscan",
+				Rules:          []sarifRule{},
+			}},
+			Results: []sarifResult{},
+		},
+		rules: map[string]int{},
+	}
+
+	for _, service := range services {
+		writer.ruleIndex(service)
+	}
+	return writer
+}
+
+// Get the index of the rule for a service, adding it if it isn't in the rules yet.
+func (w *sarifWriter) ruleIndex(service string) int {
+	id := sarifRuleID(service)
+	if index, ok := w.rules[id]; ok {
+		return index
+	}
+
+	rules := &w.run.Tool.Driver.Rules
+	*rules = append(*rules, sarifRule{
+		ID:   id,
+		Name: service,
+		ShortDescription: sarifMessage{
+			Text: fmt.Sprintf("CSP source can be taken over through %s", service),
+		},
+		FullDescription: sarifMessage{
+			Text: fmt.Sprintf("A Content Security Policy allows a URL hosted on %s that is no longer claimed. "+
+				"Anyone who claims it can serve content the policy trusts.", service),
+		},
+	})
+	w.rules[id] = len(*rules) - 1
+	return w.rules[id]
+}
+
+func (w *sarifWriter) Write(result Result) error {
+	if !result.Vulnerable || result.Error != nil {
+		return nil
+	}
+
+	index := w.ruleIndex(result.Service)
+	w.run.Results = append(w.run.Results, sarifResult{
+		RuleID:    w.run.Tool.Driver.Rules[index].ID,
+		RuleIndex: index,
+		Level:     sarifLevel(result.Severity),
+		Message: sarifMessage{
+			Text: fmt.Sprintf("%s allows %s in %s, which may be vulnerable to takeover through %s",
+				result.PrimaryURL, result.SecondaryURL, result.Directive, result.Service),
+		},
+		Locations: []sarifLocation{{
+			PhysicalLocation: &sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: result.PrimaryURL},
+			},
+			LogicalLocations: []sarifLogicalLocation{{
+				Name:               result.Directive,
+				FullyQualifiedName: result.Header + "/" + result.Directive,
+				Kind:               "member",
+			}},
+		}},
+		RelatedLocations: []sarifLocation{{
+			ID: 1,
+			PhysicalLocation: &sarifPhysicalLocation{
+				ArtifactLocation: sarifArtifactLocation{URI: result.SecondaryURL},
+			},
+			Message: &sarifMessage{Text: "Dangling source"},
+		}},
+		Properties: sarifProperties{
+			Severity:     result.Severity.String(),
+			SecondaryURL: result.SecondaryURL,
+			Header:       result.Header,
+			ReportOnly:   result.ReportOnly,
+			Evidence:     result.Evidence,
+			Chain:        result.Chain,
+		},
+	})
+
+	return nil
+}
+
+func (w *sarifWriter) Close() error {
+	encoder := json.NewEncoder(w.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifLog{
+		Version: sarifVersion,
+		Schema:  sarifSchema,
+		Runs:    []sarifRun{w.run},
+	})
+}
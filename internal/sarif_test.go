@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestSARIFWriter(t *testing.T) {
+	results := []Result{
+		{PrimaryURL: "https://acme.com", SecondaryURL: "https://a.cloudapp.net/app.js", Directive: "script-src",
+			Header: CSPHeader, Vulnerable: true, Service: "Microsoft Azure", Severity: SeverityHigh},
+		{PrimaryURL: "https://acme.com", SecondaryURL: "https://b.cloudapp.net/app.css", Directive: "style-src",
+			Header: CSPHeader, Vulnerable: true, Service: "Microsoft Azure", Severity: SeverityMedium},
+		{PrimaryURL: "https://shop.acme.com", SecondaryURL: "https://acme.github.io/img.png", Directive: "img-src",
+			Header: CSPHeader, Vulnerable: true, Service: "Github", Severity: SeverityInfo},
+		{PrimaryURL: "https://acme.com", SecondaryURL: "https://cdn.acme.com/app.js", Directive: "script-src"},
+	}
+
+	var out bytes.Buffer
+	writer, err := NewWriter(FormatSARIF, &out, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if err := writer.Write(result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var log sarifLog
+	if err := json.Unmarshal(out.Bytes(), &log); err != nil {
+		t.Fatal(err)
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 {
+		t.Fatalf("unexpected log: %+v", log)
+	}
+
+	run := log.Runs[0]
+	if len(run.Tool.Driver.Rules) != 2 {
+		t.Errorf("expected one rule per service, got %+v", run.Tool.Driver.Rules)
+	}
+	if len(run.Results) != 3 {
+		t.Fatalf("expected one result per vulnerable result, got %d", len(run.Results))
+	}
+
+	expectedLevels := []string{"error", "warning", "note"}
+	for i, result := range run.Results {
+		if result.Level != expectedLevels[i] {
+			t.Errorf("result %d: expected level %s, got %s", i, expectedLevels[i], result.Level)
+		}
+		if run.Tool.Driver.Rules[result.RuleIndex].ID != result.RuleID {
+			t.Errorf("result %d: rule index doesn't match rule ID %s", i, result.RuleID)
+		}
+	}
+
+	location := run.Results[0].Locations[0]
+	if location.PhysicalLocation.ArtifactLocation.URI != "https://acme.com" ||
+		location.LogicalLocations[0].Name != "script-src" {
+		t.Errorf("unexpected location: %+v", location)
+	}
+	if run.Results[2].RuleID != "takeover/github" {
+		t.Errorf("expected rule ID takeover/github, got %s", run.Results[2].RuleID)
+	}
+}
+
+func TestSARIFWriterSeedsRules(t *testing.T) {
+	services := ScanServices([]Fingerprint{{Service: "Github"}, {Service: "Shopify"}, {Service: "Github"}})
+
+	var out bytes.Buffer
+	writer, err := NewWriter(FormatSARIF, &out, WriterOptions{Services: services})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writer.Write(Result{PrimaryURL: "https://acme.com", SecondaryURL: "https://acme.myshopify.com", Directive: "script-src",
+		Vulnerable: true, Service: "Shopify", Severity: SeverityHigh})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var log sarifLog
+	if err := json.Unmarshal(out.Bytes(), &log); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every fingerprint service and bucket provider has a rule, whether or not it had a finding
+	run := log.Runs[0]
+	if len(run.Tool.Driver.Rules) != 2+len(bucketProviders) {
+		t.Fatalf("expected a rule per service, got %+v", run.Tool.Driver.Rules)
+	}
+	if run.Tool.Driver.Rules[0].Name != "Github" || run.Tool.Driver.Rules[2].Name != ProviderS3 {
+		t.Errorf("expected rules in fingerprint order followed by bucket providers, got %+v", run.Tool.Driver.Rules)
+	}
+	if result := run.Results[0]; result.RuleIndex != 1 || result.RuleID != "takeover/shopify" {
+		t.Errorf("expected the finding to use the seeded Shopify rule, got %s at %d", result.RuleID, result.RuleIndex)
+	}
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Severity of a finding, ordered so that findings can be compared against a minimum.
+type Severity int
+
+const (
+	// Not a finding
+	SeverityNone Severity = iota
+	SeverityInfo
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+)
+
+var severityNames = map[Severity]string{
+	SeverityNone:   "none",
+	SeverityInfo:   "info",
+	SeverityLow:    "low",
+	SeverityMedium: "medium",
+	SeverityHigh:   "high",
+}
+
+func (s Severity) String() string {
+	name, ok := severityNames[s]
+	if !ok {
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+	return name
+}
+
+// Parse a severity name, like "medium". "none" isn't a finding's severity, so it isn't accepted.
+func ParseSeverity(name string) (Severity, error) {
+	for severity, severityName := range severityNames {
+		if severity != SeverityNone && strings.EqualFold(name, severityName) {
+			return severity, nil
+		}
+	}
+
+	return SeverityNone, fmt.Errorf("unknown severity %q, expected one of info, low, medium or high", name)
+}
+
+// How sure a check is that a finding can really be taken over.
+type Confidence string
+
+const (
+	ConfidenceHigh Confidence = "high"
+	// The fingerprint is marked as an edge case upstream, or the check is a heuristic
+	ConfidenceLow Confidence = "low"
+)
+
+// Severity of a takeover in each directive, based on what an attacker controlling the source could do.
+// Directives that aren't listed, like img-src and font-src, are low.
+var directiveSeverity = map[string]Severity{
+	// Script execution
+	"default-src":     SeverityHigh,
+	"script-src":      SeverityHigh,
+	"script-src-elem": SeverityHigh,
+	"script-src-attr": SeverityHigh,
+	"object-src":      SeverityHigh,
+	"worker-src":      SeverityHigh,
+	"base-uri":        SeverityHigh,
+	// Data exfiltration, UI redressing and CSS injection
+	"style-src":      SeverityMedium,
+	"style-src-elem": SeverityMedium,
+	"style-src-attr": SeverityMedium,
+	"connect-src":    SeverityMedium,
+	"frame-src":      SeverityMedium,
+	"child-src":      SeverityMedium,
+	"form-action":    SeverityMedium,
+}
+
+// Score a finding from the directive its source appeared in. Findings in report-only policies and
+// findings with low confidence are each one level lower, down to info.
+func scoreSeverity(directive string, reportOnly bool, confidence Confidence) Severity {
+	severity, ok := directiveSeverity[directive]
+	if !ok {
+		severity = SeverityLow
+	}
+
+	if reportOnly {
+		severity--
+	}
+
+	if confidence == ConfidenceLow {
+		severity--
+	}
+
+	if severity < SeverityInfo {
+		severity = SeverityInfo
+	}
+
+	return severity
+}
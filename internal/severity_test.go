@@ -0,0 +1,47 @@
+package internal
+
+import "testing"
+
+func TestScoreSeverity(t *testing.T) {
+	tests := []struct {
+		directive  string
+		reportOnly bool
+		confidence Confidence
+		expected   Severity
+	}{
+		{"script-src", false, ConfidenceHigh, SeverityHigh},
+		{"default-src", false, ConfidenceHigh, SeverityHigh},
+		{"object-src", false, ConfidenceHigh, SeverityHigh},
+		{"style-src", false, ConfidenceHigh, SeverityMedium},
+		{"connect-src", false, ConfidenceHigh, SeverityMedium},
+		{"img-src", false, ConfidenceHigh, SeverityLow},
+		{"font-src", false, ConfidenceHigh, SeverityLow},
+		{"script-src", true, ConfidenceHigh, SeverityMedium},
+		{"script-src", false, ConfidenceLow, SeverityMedium},
+		{"script-src", true, ConfidenceLow, SeverityLow},
+		{"img-src", true, ConfidenceLow, SeverityInfo},
+	}
+
+	for _, test := range tests {
+		got := scoreSeverity(test.directive, test.reportOnly, test.confidence)
+		if got != test.expected {
+			t.Errorf("%s (report-only %v, %s confidence): expected %s, got %s",
+				test.directive, test.reportOnly, test.confidence, test.expected, got)
+		}
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	severity, err := ParseSeverity("Medium")
+	if err != nil || severity != SeverityMedium {
+		t.Errorf("expected medium, got %s (%v)", severity, err)
+	}
+
+	if _, err := ParseSeverity("critical"); err == nil {
+		t.Error("expected error for unknown severity")
+	}
+
+	if _, err := ParseSeverity("none"); err == nil {
+		t.Error("expected error for none, which isn't a finding's severity")
+	}
+}
@@ -1,29 +1,51 @@
 package internal
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	URL "net/url"
 	"reflect"
-	"regexp"
+	"strings"
 )
 
+// Maximum number of CNAME records followed before giving up on a chain, to avoid
+// looping forever on misconfigured (or malicious) records.
+const maxCNAMEDepth = 10
+
 // Fingerprint imported from https://github.com/EdOverflow/can-i-take-over-xyz with regex checks for common subdomain takeover vulnerabilities.
 type Fingerprint struct {
-	Cname []string `json:"cname"`
-	Discussion string `json:"discussion"`
-	Fingerprint string `json:"fingerprint"`
-	NXDomain bool `json:"nxdomain"`
-	Service string `json:"service"`
-	Vulnerable bool `json:"vulnerable"`
+	Cname []string `json:"cname" yaml:"cname"`
+	Discussion string `json:"discussion" yaml:"discussion"`
+	Fingerprint string `json:"fingerprint" yaml:"fingerprint"`
+	NXDomain bool `json:"nxdomain" yaml:"nxdomain"`
+	Service string `json:"service" yaml:"service"`
+	Vulnerable bool `json:"vulnerable" yaml:"vulnerable"`
+	// Upstream status, like "Vulnerable" or "Edge case"
+	Status string `json:"status" yaml:"status"`
+	HTTPStatus int `json:"http_status" yaml:"http_status"`
+	// Extra response matchers, which aren't part of the can-i-take-over-xyz format. See Matcher.
+	Matchers []Matcher `json:"matchers,omitempty" yaml:"matchers,omitempty"`
+	// How the matchers are combined, either "and" (default) or "or"
+	MatchersCondition string `json:"matchers_condition,omitempty" yaml:"matchers_condition,omitempty"`
+
+	// Every matcher with its patterns compiled, set when fingerprints are loaded
+	compiled []Matcher
 }
 
-func (f Fingerprint) containsUrl(url URL.URL) bool {
+// Check if the host is one of the fingerprint's CNAMEs, or a subdomain of one.
+// For example, "acme.s3.amazonaws.com" matches a fingerprint CNAME of "s3.amazonaws.com".
+func (f Fingerprint) matchesHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
 	for _, cname := range f.Cname {
-		if cname == url.Host {
+		cname = strings.ToLower(strings.TrimSuffix(cname, "."))
+		if cname == "" {
+			continue
+		}
+
+		if host == cname || strings.HasSuffix(host, "."+cname) {
 			return true
 		}
 	}
@@ -31,7 +53,17 @@ func (f Fingerprint) containsUrl(url URL.URL) bool {
 	return false
 }
 
+// Get how reliable the fingerprint is. Upstream "Edge case" fingerprints only work in some setups.
+func (f Fingerprint) confidence() Confidence {
+	if strings.EqualFold(f.Status, "Edge case") {
+		return ConfidenceLow
+	}
+	return ConfidenceHigh
+}
+
 func (f Fingerprint) IsSameAs(other Fingerprint) bool {
+	// Compiled matchers only cache what the exported fields already say
+	f.compiled, other.compiled = nil, nil
 	return reflect.DeepEqual(f, other)
 }
 
@@ -46,7 +78,7 @@ func GetFingerprints(testingReplacementURL string, client *http.Client) ([]Finge
 	if testingReplacementURL != "" {
 		url = testingReplacementURL
 	} else {
-		url = "https://raw.githubusercontent.com/EdOverflow/can-i-take-over-xyz/refs/heads/master/fingerprints.json"
+		url = fingerprintsURL
 	}
 	
 	res, err := client.Get(url)
@@ -60,34 +92,74 @@ func GetFingerprints(testingReplacementURL string, client *http.Client) ([]Finge
 		return nil, fmt.Errorf("failed to update subdomain takeover fingerprints: %v", err)
 	}
 
-	var fingerprints []Fingerprint
-	err = json.Unmarshal(bytes, &fingerprints)
+	fingerprints, err := parseFingerprints(bytes)
 	if err != nil {
 		return nil, fmt.Errorf("failed to update subdomain takeover fingerprints: %v", err)
 	}
 
-	// Remove non-vulnerable fingerprints from list
-	for index, fingerprint := range fingerprints {
-		if fingerprint.Vulnerable{
-			continue
+	return fingerprints, nil
+}
+
+// Follow the CNAME records of a host one hop at a time. The returned chain always starts with
+// the host itself and ends with the last name that was found, which is where the host actually lands.
+// A host that doesn't exist is returned as a chain of just itself, so checkNXDomain can decide on it.
+func resolveCNAMEChain(ctx context.Context, host string, resolver Resolver) ([]string, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	chain := []string{host}
+
+	// IP addresses have no DNS records to follow
+	if net.ParseIP(host) != nil {
+		return chain, nil
+	}
+
+	seen := map[string]bool{host: true}
+	current := host
+	for i := 0; i < maxCNAMEDepth; i++ {
+		target, err := resolver.LookupCNAME(ctx, current)
+		if err != nil {
+			if isNotFound(err) {
+				break
+			}
+			return chain, fmt.Errorf("failed to resolve CNAME for %s: %w", current, err)
 		}
 
-		if index < len(fingerprints) - 1 {
-			fingerprints = append(fingerprints[:index], fingerprints[index+1:]... )
-		} else {
-			fingerprints = fingerprints[:index]
+		target = strings.ToLower(strings.TrimSuffix(target, "."))
+		if target == "" || target == current {
+			break // No more CNAME records
 		}
+
+		if seen[target] {
+			return chain, &ScanError{Kind: ErrorDNS, Err: fmt.Errorf("CNAME loop detected for %s at %s", host, target)}
+		}
+		seen[target] = true
+
+		chain = append(chain, target)
+		current = target
 	}
 
-	return fingerprints, nil
+	return chain, nil
+}
+
+// Find the fingerprint for the service a CNAME chain lands on. Hosts later in the chain
+// are checked first, so the final destination decides the fingerprint rather than an
+// intermediate alias.
+func matchFingerprint(chain []string, fingerprints []Fingerprint) (Fingerprint, bool) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, fingerprint := range fingerprints {
+			if fingerprint.matchesHost(chain[i]) {
+				return fingerprint, true
+			}
+		}
+	}
+
+	return Fingerprint{}, false
 }
 
-// Check if a URL returns an NXDOMAIN response to DNS lookups.
-func checkNXDomain(url string) (bool, error) {
-	_, err := net.LookupHost(url)
+// Check if a host returns an NXDOMAIN response to DNS lookups.
+func checkNXDomain(ctx context.Context, host string, resolver Resolver) (bool, error) {
+	_, err := resolver.LookupHost(ctx, host)
 	if err != nil {
-		dnsErr, ok := err.(*net.DNSError)
-		if ok && dnsErr.IsNotFound {
+		if isNotFound(err) {
 			return true, nil
 		}
 		return false, err
@@ -96,55 +168,169 @@ func checkNXDomain(url string) (bool, error) {
 	return false, nil
 }
 
-// Send a GET request to the URL and check the response for the regex from the fingerprint.
+// Check for a dangling NS delegation, where the host is delegated to nameservers of a
+// fingerprinted service, but those nameservers no longer answer for the host.
+// The matched fingerprint is returned, along with whether the delegation is dangling.
+func checkDelegation(ctx context.Context, host string, fingerprints []Fingerprint, resolver Resolver) (*Fingerprint, bool, error) {
+	nameservers, err := resolver.LookupNS(ctx, host)
+	if err != nil {
+		if isNotFound(err) {
+			// Host is not delegated, so there is nothing to take over
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to resolve NS for %s: %w", host, err)
+	}
+
+	var hosts []string
+	for _, nameserver := range nameservers {
+		hosts = append(hosts, nameserver.Host)
+	}
+
+	fingerprint, ok := matchFingerprint(hosts, fingerprints)
+	if !ok {
+		return nil, false, nil
+	}
+
+	// Only NXDOMAIN means the delegated zone is gone. Timeouts and other failures say nothing
+	// about the zone, so they are errors rather than findings.
+	_, err = resolver.LookupHost(ctx, host)
+	if err != nil {
+		if isNotFound(err) {
+			return &fingerprint, true, nil
+		}
+		return &fingerprint, false, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	return &fingerprint, false, nil
+}
+
+// Send a GET request to the URL and check the response against the fingerprint's matchers.
 // If the fingerprint matches, the URL may be vulnerable to subdomain takeover.
-func checkResponse(url string, regex *regexp.Regexp, client *http.Client) (bool, error){
-	res, err := client.Get(url)
+// The response's status code is returned along with the verdict.
+func checkResponse(ctx context.Context, url string, fingerprint Fingerprint, client *http.Client) (bool, int, error){
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		return false, fmt.Errorf("failed to GET %s: %v", url, err)
+		return false, 0, err
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to GET %s: %w", url, err)
 	}
 	defer res.Body.Close()
 
 	bytes, err := io.ReadAll(res.Body)
 	if err != nil {
-		return false, fmt.Errorf("failed to parse response: %v", err)
+		return false, res.StatusCode, fmt.Errorf("failed to parse response: %w", err)
 	}
 
-	return regex.Match(bytes), nil
-
+	matched, err := fingerprint.matchResponse(res, bytes)
+	return matched, res.StatusCode, err
+}
 
+// Outcome of checking a URL with CheckURL.
+type Check struct {
+	Vulnerable bool
+	// Service of the matched fingerprint or bucket provider, empty if nothing matched
+	Service string
+	// CNAME chain of the URL's host, starting with the host itself
+	CNAMEChain []string
+	// Set if the URL is a cloud storage bucket
+	Bucket *Bucket
+	// How reliable the check is, if the URL is vulnerable
+	Confidence Confidence
+	// What the verdict was based on, like the CNAME chain and the matched response
+	Evidence []string
+	// Status code of the response the verdict was based on, or 0 if no request was sent
+	HTTPStatus int
+	// Most attempts any request for the check took, counting retries, or 0 if no request was sent
+	Attempts int
 }
 
-// Check if the provided URL may be vulnerable to subdomain takeover.
+// Check if the provided URL may be vulnerable to subdomain takeover. The CNAME chain of the
+// URL's host is resolved, and if it points at a cloud storage bucket, the bucket is checked
+// directly. Otherwise the fingerprint for the service at the end of the chain is used.
 //
 // Parameters:
-// 	- rawURL: URL to check. Only host is read, so protocol and path are ignored.
+// 	- rawURL: URL to check. The host picks the fingerprint and the path may contain a bucket name.
+//		The full URL is requested for fingerprints that match on the response.
 // 	- fingerprints: Detection fingerprint regexes are passed in as a parameter so only one
 // 		call to GetFingerprints() is needed.
-func CheckURL(rawURL string, fingerprints []Fingerprint, client *http.Client) (bool, error) {
+// 	- resolver: Resolver used for the CNAME, A/AAAA and NS lookups that decide the verdict.
+func CheckURL(ctx context.Context, rawURL string, fingerprints []Fingerprint, client *http.Client, resolver Resolver) (Check, error) {
 	url, err := URL.Parse(rawURL)
 	if err != nil {
-		return false, fmt.Errorf("failed to parse URL %s: %v", url, err)
+		return Check{}, fmt.Errorf("failed to parse URL %s: %w", rawURL, err)
 	}
 
-	for _, fingerprint := range fingerprints {
-		if !fingerprint.containsUrl(*url) {
-			continue
-		}
+	chain, err := resolveCNAMEChain(ctx, url.Hostname(), resolver)
+	if err != nil {
+		return Check{CNAMEChain: chain}, err
+	}
 
-		if (fingerprint.NXDomain) {
-			return checkNXDomain(rawURL)
-		} 
+	return checkResolvedURL(ctx, rawURL, url, chain, fingerprints, client, resolver)
+}
 
-		re, err := regexp.Compile(fingerprint.Fingerprint)
+// Check a URL whose host has already been resolved to its CNAME chain, the rest of CheckURL.
+func checkResolvedURL(ctx context.Context, rawURL string, url *URL.URL, chain []string, fingerprints []Fingerprint, client *http.Client, resolver Resolver) (check Check, err error) {
+	ctx, attempts := withAttemptCounter(ctx)
+	defer func() {
+		check.Attempts = attempts.attempts()
+	}()
+
+	check.CNAMEChain = chain
+	if len(check.CNAMEChain) > 1 {
+		check.Evidence = append(check.Evidence, "CNAME chain: "+strings.Join(check.CNAMEChain, " -> "))
+	}
+
+	if bucket, ok := findBucket(url, check.CNAMEChain); ok {
+		err = checkBucket(ctx, &bucket, client, resolver)
 		if err != nil {
-			return false, fmt.Errorf("failed to compile vulnerability detection fingerprint %s:  %v", fingerprint.Fingerprint, err)
+			return check, err
 		}
 
-		return checkResponse(rawURL, re, client)
+		check.Service = bucket.Provider
+		check.Bucket = &bucket
+		check.Vulnerable = bucket.Claimable
+		check.Confidence = ConfidenceHigh
+		check.HTTPStatus = bucket.Status
+		check.Evidence = append(check.Evidence, bucket.evidence())
+		return check, nil
 	}
 
-	// URL did not match any fingerprint
-	return false, nil
-}
+	fingerprint, ok := matchFingerprint(check.CNAMEChain, fingerprints)
+	if !ok {
+		// URL did not match any fingerprint by CNAME, but may still be delegated to one
+		if net.ParseIP(url.Hostname()) != nil {
+			return check, nil
+		}
+
+		matched, vulnerable, err := checkDelegation(ctx, url.Hostname(), fingerprints, resolver)
+		if matched != nil {
+			check.Service = matched.Service
+			// Failing lookups don't always mean the delegated zone is gone
+			check.Confidence = ConfidenceLow
+		}
+		check.Vulnerable = vulnerable
+		if vulnerable {
+			check.Evidence = append(check.Evidence, fmt.Sprintf("%s is delegated to %s nameservers, but doesn't resolve", url.Hostname(), matched.Service))
+		}
+		return check, err
+	}
+
+	check.Service = fingerprint.Service
+	check.Confidence = fingerprint.confidence()
+	if fingerprint.NXDomain {
+		check.Vulnerable, err = checkNXDomain(ctx, url.Hostname(), resolver)
+		if check.Vulnerable {
+			check.Evidence = append(check.Evidence, url.Hostname()+" returned NXDOMAIN")
+		}
+	} else {
+		check.Vulnerable, check.HTTPStatus, err = checkResponse(ctx, rawURL, fingerprint, client)
+		if check.Vulnerable {
+			check.Evidence = append(check.Evidence, fmt.Sprintf("Response from %s matched the %s fingerprint", rawURL, fingerprint.Service))
+		}
+	}
 
+	return check, err
+}
@@ -1,10 +1,12 @@
 package internal
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"regexp"
+	"reflect"
 	"testing"
 )
 
@@ -50,6 +52,7 @@ func TestGetFingerprints(t *testing.T) {
 			NXDomain: true,
 			Service: "AWS/Elastic Beanstalk",
 			Vulnerable: true,
+			Status: "Vulnerable",
 		 },
 	}
 
@@ -76,16 +79,17 @@ func TestCheckResponse(t *testing.T) {
 	}))
 	defer server.Close()
 
-	re, err := regexp.Compile("test")
-	if err != nil {
-		t.Errorf("failed to compile regex: %v", err)
-	}
+	fingerprint := Fingerprint{Fingerprint: "test"}
 
-	vuln, err := checkResponse(server.URL, re, http.DefaultClient)
+	vuln, status, err := checkResponse(context.Background(), server.URL, fingerprint, http.DefaultClient)
 	if err != nil {
 		t.Error(err)
 	}
 
+	if status != http.StatusOK {
+		t.Errorf("expected status 200, got %d", status)
+	}
+
 	if vuln != true {
 		t.Error("regex not detected in response")
 	}
@@ -104,18 +108,222 @@ func TestCheckURL(t *testing.T) {
 	}
 
 	exampleFingerprint := Fingerprint{
-		Cname: []string{parsedURL.Host},
+		Cname: []string{parsedURL.Hostname()},
 		Fingerprint: "test",
 		NXDomain: false,
 		Vulnerable: true,
 	}
 
-	vuln, err := CheckURL(server.URL, []Fingerprint{exampleFingerprint}, http.DefaultClient)
+	check, err := CheckURL(context.Background(), server.URL, []Fingerprint{exampleFingerprint}, http.DefaultClient, NewSystemResolver())
 	if err != nil {
 		t.Error(err)
 	}
 
-	if vuln != true {
+	if check.Vulnerable != true {
 		t.Error("regex not detected in response")
 	}
-}
\ No newline at end of file
+}
+func TestMatchesHost(t *testing.T) {
+	fingerprint := Fingerprint{Cname: []string{"s3.amazonaws.com", "cloudfront.net."}}
+
+	tests := []struct {
+		host     string
+		expected bool
+	}{
+		{"s3.amazonaws.com", true},
+		{"acme.s3.amazonaws.com", true},
+		{"ACME.S3.AMAZONAWS.COM.", true},
+		{"d111111abcdef8.cloudfront.net", true},
+		{"evils3.amazonaws.com", false},
+		{"s3.amazonaws.com.evil.com", false},
+		{"amazonaws.com", false},
+	}
+
+	for _, test := range tests {
+		got := fingerprint.matchesHost(test.host)
+		if got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.host, test.expected, got)
+		}
+	}
+}
+
+func TestMatchFingerprint(t *testing.T) {
+	s3 := Fingerprint{Cname: []string{"s3.amazonaws.com"}, Service: "AWS/S3"}
+	heroku := Fingerprint{Cname: []string{"herokuapp.com"}, Service: "Heroku"}
+	fingerprints := []Fingerprint{s3, heroku}
+
+	// The end of the chain decides the fingerprint, even if an earlier alias also matches one
+	chain := []string{"assets.acme.com", "acme.herokuapp.com", "acme.s3.amazonaws.com"}
+	fingerprint, ok := matchFingerprint(chain, fingerprints)
+	if !ok || !fingerprint.IsSameAs(s3) {
+		t.Errorf("expected %+v, got %+v", s3, fingerprint)
+	}
+
+	chain = []string{"assets.acme.com", "acme.herokuapp.com", "proxy.acme.net"}
+	fingerprint, ok = matchFingerprint(chain, fingerprints)
+	if !ok || !fingerprint.IsSameAs(heroku) {
+		t.Errorf("expected %+v, got %+v", heroku, fingerprint)
+	}
+
+	chain = []string{"assets.acme.com", "proxy.acme.net"}
+	if _, ok := matchFingerprint(chain, fingerprints); ok {
+		t.Error("expected no fingerprint to match")
+	}
+}
+
+func TestResolveCNAMEChainIP(t *testing.T) {
+	chain, err := resolveCNAMEChain(context.Background(), "127.0.0.1", fakeResolver{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if !reflect.DeepEqual(chain, []string{"127.0.0.1"}) {
+		t.Errorf("expected chain of just the IP, got %v", chain)
+	}
+}
+
+func TestResolveCNAMEChain(t *testing.T) {
+	resolver := fakeResolver{
+		cnames: map[string]string{
+			"assets.acme.com":       "acme.s3.amazonaws.com",
+			"acme.s3.amazonaws.com": "s3-1-w.amazonaws.com",
+			"loop-a.acme.com":       "loop-b.acme.com",
+			"loop-b.acme.com":       "loop-a.acme.com",
+			"dangling.acme.com":     "acme.cloudapp.net",
+		},
+		hosts: map[string][]string{
+			"s3-1-w.amazonaws.com": {"52.216.0.1"},
+		},
+	}
+
+	chain, err := resolveCNAMEChain(context.Background(), "Assets.Acme.com.", resolver)
+	if err != nil {
+		t.Error(err)
+	}
+	expected := []string{"assets.acme.com", "acme.s3.amazonaws.com", "s3-1-w.amazonaws.com"}
+	if !reflect.DeepEqual(chain, expected) {
+		t.Errorf("expected %v, got %v", expected, chain)
+	}
+
+	// The target of a dangling CNAME is still part of the chain
+	chain, err = resolveCNAMEChain(context.Background(), "dangling.acme.com", resolver)
+	if err != nil {
+		t.Error(err)
+	}
+	expected = []string{"dangling.acme.com", "acme.cloudapp.net"}
+	if !reflect.DeepEqual(chain, expected) {
+		t.Errorf("expected %v, got %v", expected, chain)
+	}
+
+	if _, err := resolveCNAMEChain(context.Background(), "loop-a.acme.com", resolver); err == nil {
+		t.Error("expected error for CNAME loop")
+	}
+}
+
+func TestCheckURLNXDomain(t *testing.T) {
+	resolver := fakeResolver{
+		cnames: map[string]string{
+			"dangling.acme.com": "acme.cloudapp.net",
+			"live.acme.com":     "live.cloudapp.net",
+		},
+		hosts: map[string][]string{
+			"live.cloudapp.net": {"20.0.0.1"},
+		},
+	}
+
+	fingerprints := []Fingerprint{{
+		Cname:       []string{"cloudapp.net"},
+		Fingerprint: "NXDOMAIN",
+		NXDomain:    true,
+		Service:     "Microsoft Azure",
+		Vulnerable:  true,
+	}}
+
+	check, err := CheckURL(context.Background(), "https://dangling.acme.com/script.js", fingerprints, http.DefaultClient, resolver)
+	if err != nil {
+		t.Error(err)
+	}
+	if !check.Vulnerable {
+		t.Error("expected dangling CNAME to be vulnerable")
+	}
+	expectedEvidence := []string{"CNAME chain: dangling.acme.com -> acme.cloudapp.net", "dangling.acme.com returned NXDOMAIN"}
+	if !reflect.DeepEqual(check.Evidence, expectedEvidence) {
+		t.Errorf("expected evidence %v, got %v", expectedEvidence, check.Evidence)
+	}
+
+	check, err = CheckURL(context.Background(), "https://live.acme.com/script.js", fingerprints, http.DefaultClient, resolver)
+	if err != nil {
+		t.Error(err)
+	}
+	if check.Vulnerable {
+		t.Error("expected resolving CNAME to not be vulnerable")
+	}
+}
+
+func TestCheckURLDelegation(t *testing.T) {
+	resolver := fakeResolver{
+		ns: map[string][]string{
+			"dangling.acme.com": {"ns1.digitalocean.com", "ns2.digitalocean.com"},
+			"live.acme.com":     {"ns1.digitalocean.com"},
+		},
+		hosts: map[string][]string{
+			"live.acme.com": {"10.0.0.1"},
+		},
+	}
+
+	fingerprints := []Fingerprint{{
+		Cname:       []string{"digitalocean.com"},
+		Fingerprint: "NXDOMAIN",
+		NXDomain:    true,
+		Service:     "Digital Ocean",
+		Vulnerable:  true,
+	}}
+
+	check, err := CheckURL(context.Background(), "https://dangling.acme.com", fingerprints, http.DefaultClient, resolver)
+	if err != nil {
+		t.Error(err)
+	}
+	if !check.Vulnerable {
+		t.Error("expected dangling delegation to be vulnerable")
+	}
+
+	check, err = CheckURL(context.Background(), "https://live.acme.com", fingerprints, http.DefaultClient, resolver)
+	if err != nil {
+		t.Error(err)
+	}
+	if check.Vulnerable {
+		t.Error("expected working delegation to not be vulnerable")
+	}
+}
+
+// Resolver whose address lookups time out, like a flaky nameserver.
+type timeoutResolver struct {
+	fakeResolver
+}
+
+func (r timeoutResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return nil, &net.DNSError{Err: "i/o timeout", Name: host, IsTimeout: true}
+}
+
+func TestCheckURLDelegationTimeout(t *testing.T) {
+	resolver := timeoutResolver{fakeResolver{
+		ns: map[string][]string{"example.com": {"ns1.digitalocean.com"}},
+	}}
+
+	fingerprints := []Fingerprint{{
+		Cname:       []string{"digitalocean.com"},
+		Fingerprint: "NXDOMAIN",
+		NXDomain:    true,
+		Service:     "Digital Ocean",
+		Vulnerable:  true,
+	}}
+
+	// A lookup that times out doesn't show the delegated zone is gone
+	check, err := CheckURL(context.Background(), "https://example.com", fingerprints, http.DefaultClient, resolver)
+	if check.Vulnerable {
+		t.Error("expected a timed out lookup to not be vulnerable")
+	}
+	if classifyError(err) != ErrorTimeout {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"os"
+
 	"github.com/osm6495/cspscan/cmd"
 )
 
 func main() {
 	err := cmd.Execute()
 	if err != nil {
-		panic(err)
+		// Cobra has already printed the error
+		os.Exit(1)
 	}
 }
\ No newline at end of file